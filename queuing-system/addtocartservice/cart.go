@@ -0,0 +1,481 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"shared/rules"
+	"shared/stock"
+)
+
+type CartLine struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+// Cart is a cart as shown to the customer, priced at today's prices.
+// Amounts are in cents. Tax is added when the order is placed.
+type Cart struct {
+	Lines      []CartLineDetail `json:"lines"`
+	ItemCount  int              `json:"item_count"`
+	TotalCents int64            `json:"total_cents"`
+
+	// ReadyForCheckout is false while a line cannot be ordered as it is.
+	ReadyForCheckout bool `json:"ready_for_checkout"`
+}
+
+type CartLineDetail struct {
+	ProductID            int    `json:"product_id"`
+	Quantity             int    `json:"quantity"`
+	Name                 string `json:"name"`
+	GenericName          string `json:"generic_name"`
+	ImageURL             string `json:"image_url"`
+	PrescriptionRequired bool   `json:"prescription_required"`
+	UnitPriceCents       int64  `json:"unit_price_cents"`
+	LineTotalCents       int64  `json:"line_total_cents"`
+
+	// PriceCentsAtAdd is the unit price when the line was last changed.
+	// It is unknown for lines from before prices were recorded.
+	PriceCentsAtAdd *int64 `json:"price_cents_at_add,omitempty"`
+
+	// Available is how many units the cart could hold now; guest lines
+	// and expired reservations have to compete for them.
+	Available          int               `json:"available"`
+	ReservedQuantity   int               `json:"reserved_quantity"`
+	ReservationExpires *time.Time        `json:"reservation_expires,omitempty"`
+	Warnings           []CartLineWarning `json:"warnings,omitempty"`
+}
+
+// CartLineWarning flags a line that has gone stale since it was added.
+// Lines that are discontinued or short of stock keep the cart from being
+// checked out; price changes and expired reservations are only pointed out.
+type CartLineWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// cartError is a reason a cart change was refused, with the status to
+// respond with.
+type cartError struct {
+	status     int
+	message    string
+	violations []rules.Violation
+}
+
+func (e *cartError) Error() string {
+	return e.message
+}
+
+func writeCartError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*cartError); ok {
+		if len(e.violations) > 0 {
+			rules.WriteViolations(w, e.violations)
+			return
+		}
+		http.Error(w, e.message, e.status)
+		return
+	}
+	log.Printf("Failed to update cart: %v", err)
+	http.Error(w, "Failed to update cart", http.StatusInternalServerError)
+}
+
+// lockForSale locks the product row for a change to a cart holding it.
+// Products that have not been priced yet cannot be bought.
+func lockForSale(tx *sql.Tx, productID int) error {
+	var priceCents int64
+	err := tx.QueryRow("SELECT price_cents FROM products WHERE id = $1 FOR UPDATE", productID).Scan(&priceCents)
+	if err == sql.ErrNoRows {
+		return &cartError{status: http.StatusNotFound, message: "Product not found"}
+	}
+	if err != nil {
+		return err
+	}
+	if priceCents <= 0 {
+		return &cartError{status: http.StatusUnprocessableEntity, message: "Product is not for sale yet"}
+	}
+	return nil
+}
+
+// setCartLine sets the quantity of a product in the user's cart, reserving
+// that many units. The purchase rules are checked against the cart as it
+// will be. quantity is computed by the caller from current, the quantity
+// already in the cart, and available, the most the cart may hold, both read
+// under the product lock. A refused change returns a *cartError before
+// anything is written, so the transaction may carry on.
+func setCartLine(tx *sql.Tx, userID, productID int, quantity func(current, available int) int) (int, time.Time, error) {
+	// The product row stays locked until the transaction ends, so
+	// concurrent changes to carts holding the product are serialised.
+	if err := lockForSale(tx, productID); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	lines, err := cartLines(tx, userID)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var current int
+	items := []rules.Line{}
+	for _, line := range lines {
+		if line.ProductID == productID {
+			current = line.Quantity
+			continue
+		}
+		items = append(items, rules.Line{ProductID: line.ProductID, Quantity: line.Quantity})
+	}
+
+	// The reservation covers every unit of the product in the cart, so
+	// units whose reservation has expired are reserved again.
+	available, err := stock.AvailableToPromise(tx, productID, userID)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	reserve := quantity(current, available)
+	if reserve <= 0 {
+		return 0, time.Time{}, &cartError{status: http.StatusBadRequest, message: "Quantity must be positive"}
+	}
+	items = append(items, rules.Line{ProductID: productID, Quantity: reserve})
+
+	if available < reserve {
+		log.Printf("Not enough stock available: requested %d, available %d", reserve, available)
+		return 0, time.Time{}, &cartError{status: http.StatusConflict, message: "Not enough stock available"}
+	}
+
+	violations, err := rules.Check(tx, userID, "", items)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if len(violations) > 0 {
+		log.Printf("Refused product %d for user %d: %v", productID, userID, violations)
+		return 0, time.Time{}, &cartError{status: http.StatusUnprocessableEntity, violations: violations}
+	}
+
+	// Changing a line accepts the product's current price.
+	_, err = tx.Exec(`INSERT INTO cart (user_id, product_id, quantity, price_cents_at_add)
+		SELECT $1, $2, $3, price_cents FROM products WHERE id = $2
+		ON CONFLICT (user_id, product_id) DO UPDATE SET quantity = EXCLUDED.quantity, price_cents_at_add = EXCLUDED.price_cents_at_add`,
+		userID, productID, reserve)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(reservationTTL)
+	_, err = tx.Exec(`INSERT INTO stock_reservations (user_id, product_id, quantity, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, product_id) WHERE order_id IS NULL
+		DO UPDATE SET quantity = EXCLUDED.quantity, expires_at = EXCLUDED.expires_at`,
+		userID, productID, reserve, expiresAt)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return reserve, expiresAt, nil
+}
+
+// queryer is a database or a transaction.
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func cartLines(q queryer, userID int) ([]CartLine, error) {
+	rows, err := q.Query("SELECT product_id, quantity FROM cart WHERE user_id = $1 ORDER BY product_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []CartLine{}
+	for rows.Next() {
+		var line CartLine
+		if err := rows.Scan(&line.ProductID, &line.Quantity); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+// removeCartLine removes a product from the user's cart and gives up its
+// reservation. It reports whether the product was in the cart.
+func removeCartLine(userID, productID int) (bool, error) {
+	var removed int
+	err := db.QueryRow(`WITH released AS (
+			DELETE FROM stock_reservations WHERE user_id = $1 AND product_id = $2 AND order_id IS NULL
+		), removed AS (
+			DELETE FROM cart WHERE user_id = $1 AND product_id = $2 RETURNING 1
+		) SELECT COUNT(*) FROM removed`, userID, productID).Scan(&removed)
+	return removed > 0, err
+}
+
+// clearUserCart empties the user's cart and gives up its reservations.
+func clearUserCart(userID int) error {
+	_, err := db.Exec(`WITH released AS (
+			DELETE FROM stock_reservations WHERE user_id = $1 AND order_id IS NULL
+		) DELETE FROM cart WHERE user_id = $1`, userID)
+	return err
+}
+
+// writeCartLine responds with a line of the cart. Guest carts hold no
+// stock, so a line without a reservation has a zero expiresAt.
+func writeCartLine(w http.ResponseWriter, message string, productID, quantity int, expiresAt time.Time) {
+	response := map[string]any{
+		"message":           message,
+		"product_id":        productID,
+		"quantity":          quantity,
+		"reserved_quantity": 0,
+	}
+	if !expiresAt.IsZero() {
+		response["reserved_quantity"] = quantity
+		response["reservation_expires"] = expiresAt
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// cartDetails prices the owner's cart and flags its stale lines.
+func cartDetails(owner cartOwner) (Cart, error) {
+	query := `SELECT c.product_id, c.quantity, c.price_cents_at_add, p.id IS NOT NULL,
+			COALESCE(p.name, ''), COALESCE(p.generic_name, ''), COALESCE(p.image_url, ''),
+			COALESCE(p.prescription_required, FALSE), COALESCE(p.price_cents, 0),
+			COALESCE(r.quantity, 0), r.expires_at
+		FROM cart c
+		LEFT JOIN products p ON p.id = c.product_id
+		LEFT JOIN stock_reservations r ON r.user_id = c.user_id AND r.product_id = c.product_id
+			AND r.order_id IS NULL AND r.expires_at > NOW()
+		WHERE c.user_id = $1 ORDER BY c.product_id`
+	var key any = owner.userID
+	if owner.guest() {
+		query = `SELECT c.product_id, c.quantity, c.price_cents_at_add, p.id IS NOT NULL,
+				COALESCE(p.name, ''), COALESCE(p.generic_name, ''), COALESCE(p.image_url, ''),
+				COALESCE(p.prescription_required, FALSE), COALESCE(p.price_cents, 0),
+				0, NULL::TIMESTAMP
+			FROM guest_carts c
+			LEFT JOIN products p ON p.id = c.product_id
+			WHERE c.session_id = $1 ORDER BY c.product_id`
+		key = owner.sessionID
+	}
+
+	cart := Cart{Lines: []CartLineDetail{}, ReadyForCheckout: true}
+	var exists []bool
+	rows, err := db.Query(query, key)
+	if err != nil {
+		return cart, err
+	}
+	for rows.Next() {
+		var line CartLineDetail
+		var found bool
+		var priceAtAdd sql.NullInt64
+		var expires sql.NullTime
+		err := rows.Scan(&line.ProductID, &line.Quantity, &priceAtAdd, &found, &line.Name, &line.GenericName,
+			&line.ImageURL, &line.PrescriptionRequired, &line.UnitPriceCents, &line.ReservedQuantity, &expires)
+		if err != nil {
+			rows.Close()
+			return cart, err
+		}
+		if priceAtAdd.Valid {
+			line.PriceCentsAtAdd = &priceAtAdd.Int64
+		}
+		if expires.Valid {
+			line.ReservationExpires = &expires.Time
+		}
+		cart.Lines = append(cart.Lines, line)
+		exists = append(exists, found)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return cart, err
+	}
+
+	for i := range cart.Lines {
+		line := &cart.Lines[i]
+		if !exists[i] {
+			line.Warnings = append(line.Warnings, CartLineWarning{"discontinued", "This product is no longer sold"})
+			cart.ReadyForCheckout = false
+			continue
+		}
+
+		line.Available, err = stock.AvailableToPromise(db, line.ProductID, owner.userID)
+		if err != nil {
+			return cart, err
+		}
+		line.Available = max(line.Available, 0)
+		line.LineTotalCents = line.UnitPriceCents * int64(line.Quantity)
+		cart.ItemCount += line.Quantity
+		cart.TotalCents += line.LineTotalCents
+
+		switch {
+		case line.Available == 0:
+			line.Warnings = append(line.Warnings, CartLineWarning{"out_of_stock", "This product is out of stock"})
+		case line.Available < line.Quantity:
+			line.Warnings = append(line.Warnings, CartLineWarning{"insufficient_stock",
+				fmt.Sprintf("Only %d left in stock", line.Available)})
+		case !owner.guest() && line.ReservedQuantity < line.Quantity:
+			// Still in stock, but no longer held for the customer.
+			line.Warnings = append(line.Warnings, CartLineWarning{"reservation_expired",
+				"This item is no longer reserved for you"})
+		}
+		if line.Available < line.Quantity {
+			cart.ReadyForCheckout = false
+		}
+
+		if line.PriceCentsAtAdd != nil && *line.PriceCentsAtAdd != line.UnitPriceCents {
+			line.Warnings = append(line.Warnings, CartLineWarning{"price_changed",
+				fmt.Sprintf("The price has changed from %.2f to %.2f since this was added",
+					float64(*line.PriceCentsAtAdd)/100, float64(line.UnitPriceCents)/100)})
+		}
+	}
+	return cart, nil
+}
+
+func getCart(w http.ResponseWriter, r *http.Request) {
+	log.Print("getCart invoked")
+
+	cart, err := cartDetails(currentCartOwner(r))
+	if err != nil {
+		log.Printf("Error fetching cart: %v", err)
+		http.Error(w, "Error fetching cart items", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cart)
+}
+
+// addToCart adds to the quantity of a product in the cart.
+func addToCart(w http.ResponseWriter, r *http.Request) {
+	log.Print("addtocart invoked")
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	owner := currentCartOwner(r)
+
+	var item CartItem
+	err := json.NewDecoder(r.Body).Decode(&item)
+	if err != nil || item.Quantity <= 0 {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if !owner.guest() && item.UserID != 0 && item.UserID != owner.userID {
+		http.Error(w, "Cart user does not match the authenticated user", http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	quantity, expiresAt, err := owner.setLine(tx, item.ProductID, func(current, available int) int {
+		return current + item.Quantity
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeCartError(w, err)
+		return
+	}
+
+	log.Printf("Successfully added item to cart of %s", owner)
+	writeCartLine(w, "Item successfully added to cart", item.ProductID, quantity, expiresAt)
+}
+
+// updateCartItem sets the quantity of a product already in the cart.
+func updateCartItem(w http.ResponseWriter, r *http.Request) {
+	log.Print("updateCartItem invoked")
+
+	productID, err := strconv.Atoi(r.PathValue("productId"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	var update struct {
+		Quantity int `json:"quantity"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	owner := currentCartOwner(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	inCart := true
+	quantity, expiresAt, err := owner.setLine(tx, productID, func(current, available int) int {
+		inCart = current > 0
+		return update.Quantity
+	})
+	if err == nil && !inCart {
+		err = &cartError{status: http.StatusNotFound, message: "Product is not in the cart"}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeCartError(w, err)
+		return
+	}
+
+	log.Printf("Set quantity of product %d in cart of %s to %d", productID, owner, quantity)
+	writeCartLine(w, "Cart updated", productID, quantity, expiresAt)
+}
+
+// removeCartItem removes a product from the cart.
+func removeCartItem(w http.ResponseWriter, r *http.Request) {
+	log.Print("removeCartItem invoked")
+
+	productID, err := strconv.Atoi(r.PathValue("productId"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	owner := currentCartOwner(r)
+
+	removed, err := owner.removeLine(productID)
+	if err != nil {
+		log.Printf("Failed to remove product %d from cart of %s: %v", productID, owner, err)
+		http.Error(w, "Failed to update cart", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Product is not in the cart", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Item removed from cart"})
+}
+
+func clearCart(w http.ResponseWriter, r *http.Request) {
+	log.Print("clearCart invoked")
+
+	err := currentCartOwner(r).clear()
+	if err != nil {
+		http.Error(w, "Error deleting cart items", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Cart items deleted successfully!"})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"shared/auth"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// The catalog is the products table. Columns other services rely on, such
+// as quantity and price_cents, are added here as well so the catalog works
+// whichever service starts first. A product's price_cents is 0 until it
+// has been priced; it cannot be bought before then.
+const catalogSchema = `
+ALTER TABLE products ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT '';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS generic_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS category TEXT NOT NULL DEFAULT '';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS image_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS price_cents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS prescription_required BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE INDEX IF NOT EXISTS products_category_idx ON products (LOWER(category));`
+
+// Product is a catalog entry. Prices are in cents.
+type Product struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	GenericName string `json:"generic_name"`
+	Description string `json:"description"`
+	Category    string `json:"category"`
+	ImageURL    string `json:"image_url"`
+	PriceCents  int64  `json:"price_cents"`
+	Quantity    int    `json:"quantity"`
+
+	PrescriptionRequired bool `json:"prescription_required"`
+}
+
+type ProductPage struct {
+	Products []Product `json:"products"`
+	Page     int       `json:"page"`
+	PageSize int       `json:"page_size"`
+	Total    int       `json:"total"`
+}
+
+const productColumns = "id, name, generic_name, description, category, image_url, price_cents, quantity, prescription_required"
+
+func initCatalog() error {
+	_, err := db.Exec(catalogSchema)
+	if err != nil {
+		return fmt.Errorf("error creating catalog columns: %w", err)
+	}
+	return nil
+}
+
+func scanProduct(scan func(...any) error) (Product, error) {
+	var p Product
+	err := scan(&p.ID, &p.Name, &p.GenericName, &p.Description, &p.Category, &p.ImageURL, &p.PriceCents, &p.Quantity, &p.PrescriptionRequired)
+	return p, err
+}
+
+// pageParams reads page and page_size from the query string.
+func pageParams(r *http.Request) (int, int, error) {
+	page, pageSize := 1, defaultPageSize
+
+	if v := r.URL.Query().Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("invalid page %q", v)
+		}
+		page = n
+	}
+
+	if v := r.URL.Query().Get("page_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return 0, 0, fmt.Errorf("invalid page_size %q", v)
+		}
+		pageSize = n
+	}
+
+	return page, pageSize, nil
+}
+
+// listProducts returns a page of the catalog, optionally narrowed to a
+// category and to products whose name or description contains q.
+func listProducts(w http.ResponseWriter, r *http.Request) {
+	log.Print("listProducts invoked")
+
+	page, pageSize, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var conditions []string
+	var args []any
+	if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+		args = append(args, "%"+q+"%")
+		conditions = append(conditions, fmt.Sprintf("(name ILIKE $%d OR description ILIKE $%d)", len(args), len(args)))
+	}
+	if category := strings.TrimSpace(r.URL.Query().Get("category")); category != "" {
+		args = append(args, category)
+		conditions = append(conditions, fmt.Sprintf("LOWER(category) = LOWER($%d)", len(args)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	result := ProductPage{Products: []Product{}, Page: page, PageSize: pageSize}
+
+	err = db.QueryRow("SELECT COUNT(*) FROM products"+where, args...).Scan(&result.Total)
+	if err != nil {
+		log.Printf("Error counting products: %v", err)
+		http.Error(w, "Error fetching products", http.StatusInternalServerError)
+		return
+	}
+
+	args = append(args, pageSize, (page-1)*pageSize)
+	query := fmt.Sprintf("SELECT %s FROM products%s ORDER BY name, id LIMIT $%d OFFSET $%d",
+		productColumns, where, len(args)-1, len(args))
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error listing products: %v", err)
+		http.Error(w, "Error fetching products", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanProduct(rows.Scan)
+		if err != nil {
+			log.Printf("Error scanning product: %v", err)
+			http.Error(w, "Error fetching products", http.StatusInternalServerError)
+			return
+		}
+		result.Products = append(result.Products, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func getProduct(w http.ResponseWriter, r *http.Request) {
+	log.Print("getProduct invoked")
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	row := db.QueryRow("SELECT "+productColumns+" FROM products WHERE id = $1", id)
+	p, err := scanProduct(row.Scan)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching product %d: %v", id, err)
+		http.Error(w, "Error fetching product", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// setProductPrice sets the price of a product from now on. Lines already in
+// carts are flagged as changed, and orders keep the price they were placed
+// at.
+func setProductPrice(w http.ResponseWriter, r *http.Request) {
+	log.Print("setProductPrice invoked")
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		PriceCents int64 `json:"price_cents"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if req.PriceCents <= 0 {
+		http.Error(w, "price_cents must be positive", http.StatusBadRequest)
+		return
+	}
+
+	row := db.QueryRow("UPDATE products SET price_cents = $1 WHERE id = $2 RETURNING "+productColumns, req.PriceCents, id)
+	p, err := scanProduct(row.Scan)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error pricing product %d: %v", id, err)
+		http.Error(w, "Error pricing product", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Product %d priced at %d cents by user %d", id, req.PriceCents, auth.CurrentUser(r).ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func listCategories(w http.ResponseWriter, r *http.Request) {
+	log.Print("listCategories invoked")
+
+	rows, err := db.Query("SELECT DISTINCT category FROM products WHERE category <> '' ORDER BY category")
+	if err != nil {
+		log.Printf("Error listing categories: %v", err)
+		http.Error(w, "Error fetching categories", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	categories := []string{}
+	for rows.Next() {
+		var category string
+		if err := rows.Scan(&category); err != nil {
+			log.Printf("Error scanning category: %v", err)
+			http.Error(w, "Error fetching categories", http.StatusInternalServerError)
+			return
+		}
+		categories = append(categories, category)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(categories)
+}
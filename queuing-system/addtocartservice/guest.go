@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"shared/auth"
+	"shared/rules"
+	"shared/stock"
+)
+
+// Customers who have not logged in shop with a guest cart, kept under a
+// random session ID that is handed out in the guest_session cookie, signed
+// so that it cannot be guessed or forged. Guest carts hold no stock; their
+// lines are checked against the stock available when they are added, and
+// reserved once the guest logs in and userservice has the cart merged into
+// theirs. Guest carts left untouched for GUEST_CART_TTL are dropped.
+const guestCartSchema = `
+CREATE TABLE IF NOT EXISTS guest_carts (
+	session_id TEXT NOT NULL,
+	product_id INTEGER NOT NULL,
+	quantity INTEGER NOT NULL CHECK (quantity > 0),
+	updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (session_id, product_id)
+);
+ALTER TABLE guest_carts ADD COLUMN IF NOT EXISTS price_cents_at_add BIGINT;`
+
+const guestCookie = "guest_session"
+
+type contextKey int
+
+const guestKey contextKey = 0
+
+var (
+	guestCartTTL = 7 * 24 * time.Hour
+
+	// The guest cookie is set like the session cookies of userservice.
+	cookieSecure = true
+	cookieDomain string
+)
+
+func initGuestCarts() error {
+	if ttl := os.Getenv("GUEST_CART_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid GUEST_CART_TTL %q", ttl)
+		}
+		guestCartTTL = d
+	}
+
+	if secure := os.Getenv("COOKIE_SECURE"); secure != "" {
+		var err error
+		cookieSecure, err = strconv.ParseBool(secure)
+		if err != nil {
+			return fmt.Errorf("invalid COOKIE_SECURE %q", secure)
+		}
+	}
+	cookieDomain = os.Getenv("COOKIE_DOMAIN")
+
+	_, err := db.Exec(guestCartSchema)
+	if err != nil {
+		return fmt.Errorf("error creating guest carts table: %w", err)
+	}
+	return nil
+}
+
+// cartOwner is whoever a cart belongs to: a user or, until they log in, a
+// guest session.
+type cartOwner struct {
+	userID    int
+	sessionID string
+}
+
+func (o cartOwner) guest() bool {
+	return o.userID == 0
+}
+
+func (o cartOwner) String() string {
+	if o.guest() {
+		return "guest " + o.sessionID[:8]
+	}
+	return fmt.Sprintf("user %d", o.userID)
+}
+
+// setLine is setCartLine for either kind of owner. Guest lines are not
+// reserved, so their expiry is zero.
+func (o cartOwner) setLine(tx *sql.Tx, productID int, quantity func(current, available int) int) (int, time.Time, error) {
+	if o.guest() {
+		n, err := setGuestCartLine(tx, o.sessionID, productID, quantity)
+		return n, time.Time{}, err
+	}
+	return setCartLine(tx, o.userID, productID, quantity)
+}
+
+func (o cartOwner) removeLine(productID int) (bool, error) {
+	if !o.guest() {
+		return removeCartLine(o.userID, productID)
+	}
+	res, err := db.Exec("DELETE FROM guest_carts WHERE session_id = $1 AND product_id = $2", o.sessionID, productID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (o cartOwner) clear() error {
+	if !o.guest() {
+		return clearUserCart(o.userID)
+	}
+	_, err := db.Exec("DELETE FROM guest_carts WHERE session_id = $1", o.sessionID)
+	return err
+}
+
+// currentCartOwner returns the owner requireCartOwner found for r.
+func currentCartOwner(r *http.Request) cartOwner {
+	if user := auth.CurrentUser(r); user.ID != 0 {
+		return cartOwner{userID: user.ID}
+	}
+	sessionID, _ := r.Context().Value(guestKey).(string)
+	return cartOwner{sessionID: sessionID}
+}
+
+// requireCartOwner lets logged in users through as requireAuth does and
+// everyone else as a guest, starting a guest session if they have none.
+// A request carrying any session of userservice is never treated as a
+// guest, so that an expired access token is refreshed rather than the
+// customer's cart silently swapped for an empty one.
+func requireCartOwner(next http.HandlerFunc) http.HandlerFunc {
+	authenticated := auth.RequireAuth(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if hasUserSession(r) {
+			authenticated(w, r)
+			return
+		}
+
+		var sessionID string
+		if cookie, err := r.Cookie(guestCookie); err == nil {
+			sessionID, _ = verifyGuestSession(cookie.Value)
+		}
+		if sessionID == "" {
+			var err error
+			sessionID, err = newGuestSession()
+			if err != nil {
+				log.Printf("Failed to start guest session: %v", err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// The cookie is set on every request so that it lives as long as
+		// the guest cart.
+		http.SetCookie(w, &http.Cookie{
+			Name:     guestCookie,
+			Value:    signGuestSession(sessionID),
+			Path:     "/",
+			Domain:   cookieDomain,
+			MaxAge:   int(guestCartTTL.Seconds()),
+			Secure:   cookieSecure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		next(w, r.WithContext(context.WithValue(r.Context(), guestKey, sessionID)))
+	}
+}
+
+func hasUserSession(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	for _, name := range []string{"token", "refresh_token"} {
+		if _, err := r.Cookie(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func newGuestSession() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// signGuestSession returns the session ID followed by its MAC under the
+// JWT secret, which only the services hold.
+func signGuestSession(sessionID string) string {
+	mac := hmac.New(sha256.New, auth.Key())
+	mac.Write([]byte(guestCookie + ":" + sessionID))
+	return sessionID + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyGuestSession returns the session ID of a signed guest session.
+func verifyGuestSession(value string) (string, bool) {
+	sessionID, _, ok := strings.Cut(value, ".")
+	if !ok || sessionID == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(signGuestSession(sessionID)), []byte(value)) {
+		return "", false
+	}
+	return sessionID, true
+}
+
+// setGuestCartLine sets the quantity of a product in a guest cart. Nothing
+// is reserved, but the quantity may not exceed the stock available now.
+func setGuestCartLine(tx *sql.Tx, sessionID string, productID int, quantity func(current, available int) int) (int, error) {
+	err := lockForSale(tx, productID)
+	if err != nil {
+		return 0, err
+	}
+
+	var current int
+	err = tx.QueryRow("SELECT quantity FROM guest_carts WHERE session_id = $1 AND product_id = $2",
+		sessionID, productID).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	available, err := stock.AvailableToPromise(tx, productID, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	n := quantity(current, available)
+	if n <= 0 {
+		return 0, &cartError{status: http.StatusBadRequest, message: "Quantity must be positive"}
+	}
+	if available < n {
+		log.Printf("Not enough stock available: requested %d, available %d", n, available)
+		return 0, &cartError{status: http.StatusConflict, message: "Not enough stock available"}
+	}
+
+	_, err = tx.Exec(`INSERT INTO guest_carts (session_id, product_id, quantity, price_cents_at_add)
+		SELECT $1, $2, $3, price_cents FROM products WHERE id = $2
+		ON CONFLICT (session_id, product_id) DO UPDATE
+		SET quantity = EXCLUDED.quantity, price_cents_at_add = EXCLUDED.price_cents_at_add, updated_at = NOW()`,
+		sessionID, productID, n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func guestCartLines(q queryer, sessionID string) ([]CartLine, error) {
+	rows, err := q.Query("SELECT product_id, quantity FROM guest_carts WHERE session_id = $1 ORDER BY product_id", sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []CartLine{}
+	for rows.Next() {
+		var line CartLine
+		if err := rows.Scan(&line.ProductID, &line.Quantity); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+// SkippedLine is a line of a guest cart that could not be merged at all.
+type SkippedLine struct {
+	ProductID  int               `json:"product_id"`
+	Quantity   int               `json:"quantity"`
+	Reason     string            `json:"reason"`
+	Violations []rules.Violation `json:"violations,omitempty"`
+}
+
+// mergeGuestCart moves a guest cart into the cart of the user, who has just
+// logged in; userservice calls it with the user's new access token and the
+// guest's signed session. Where both carts hold a product their quantities
+// are added up, capped at the stock available to the user. Lines that
+// cannot be added at all, being out of stock or refused by a purchase rule,
+// are skipped and reported. The guest cart is emptied either way.
+func mergeGuestCart(w http.ResponseWriter, r *http.Request) {
+	log.Print("mergeGuestCart invoked")
+
+	var request struct {
+		GuestSession string `json:"guest_session"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	sessionID, ok := verifyGuestSession(request.GuestSession)
+	if !ok {
+		http.Error(w, "Invalid guest session", http.StatusBadRequest)
+		return
+	}
+
+	userID := auth.CurrentUser(r).ID
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	guestLines, err := guestCartLines(tx, sessionID)
+	if err != nil {
+		log.Printf("Failed to load guest cart: %v", err)
+		http.Error(w, "Failed to merge cart", http.StatusInternalServerError)
+		return
+	}
+
+	// Products are locked in ID order, as everywhere else.
+	sort.Slice(guestLines, func(i, j int) bool { return guestLines[i].ProductID < guestLines[j].ProductID })
+
+	merged := []CartLine{}
+	skipped := []SkippedLine{}
+	for _, line := range guestLines {
+		quantity, _, err := setCartLine(tx, userID, line.ProductID, func(current, available int) int {
+			return max(current, min(current+line.Quantity, available))
+		})
+		if e, ok := err.(*cartError); ok {
+			skipped = append(skipped, SkippedLine{
+				ProductID:  line.ProductID,
+				Quantity:   line.Quantity,
+				Reason:     e.message,
+				Violations: e.violations,
+			})
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to merge product %d into cart of user %d: %v", line.ProductID, userID, err)
+			http.Error(w, "Failed to merge cart", http.StatusInternalServerError)
+			return
+		}
+		merged = append(merged, CartLine{ProductID: line.ProductID, Quantity: quantity})
+	}
+
+	_, err = tx.Exec("DELETE FROM guest_carts WHERE session_id = $1", sessionID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to merge guest cart into cart of user %d: %v", userID, err)
+		http.Error(w, "Failed to merge cart", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Merged %d guest cart lines into cart of user %d, skipped %d", len(merged), userID, len(skipped))
+	response := map[string]any{
+		"merged":  merged,
+		"skipped": skipped,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// sweepGuestCarts drops guest carts untouched for guestCartTTL every hour.
+func sweepGuestCarts() {
+	for range time.Tick(time.Hour) {
+		res, err := db.Exec(`DELETE FROM guest_carts WHERE session_id IN (
+				SELECT session_id FROM guest_carts GROUP BY session_id
+				HAVING MAX(updated_at) <= NOW() - make_interval(secs => $1)
+			)`, guestCartTTL.Seconds())
+		if err != nil {
+			log.Printf("Error dropping abandoned guest carts: %v", err)
+			continue
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			log.Printf("Dropped %d abandoned guest cart lines", n)
+		}
+	}
+}
@@ -2,21 +2,23 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
-	"sync"
 
+	"github.com/gorilla/handlers"
 	"github.com/joho/godotenv"
 
 	_ "github.com/lib/pq"
+
+	"shared/auth"
+	"shared/carts"
+	"shared/rules"
+	"shared/synonyms"
 )
 
 var db *sql.DB
-var mu sync.Mutex
 
 type CartItem struct {
 	UserID    int    `json:"user_id"`
@@ -38,12 +40,73 @@ func main() {
 		log.Fatalf("Error initializing database: %v", err)
 	}
 
+	err = auth.Init(db)
+	if err != nil {
+		log.Fatalf("Error initializing auth: %v", err)
+	}
+
+	err = initCatalog()
+	if err != nil {
+		log.Fatalf("Error initializing catalog: %v", err)
+	}
+
+	err = initSearch()
+	if err != nil {
+		log.Fatalf("Error initializing search: %v", err)
+	}
+
+	err = synonyms.Init(db)
+	if err != nil {
+		log.Fatalf("Error initializing drug synonyms: %v", err)
+	}
+
+	err = rules.Init(db)
+	if err != nil {
+		log.Fatalf("Error initializing purchase rules: %v", err)
+	}
+
+	err = initReservations()
+	if err != nil {
+		log.Fatalf("Error initializing stock reservations: %v", err)
+	}
+	go sweepReservations()
+
+	err = carts.Init(db)
+	if err != nil {
+		log.Fatalf("Error initializing cart: %v", err)
+	}
+
+	err = initGuestCarts()
+	if err != nil {
+		log.Fatalf("Error initializing guest carts: %v", err)
+	}
+	go sweepGuestCarts()
+
 	http.Handle("/", http.FileServer(http.Dir("./static")))
 
-	http.HandleFunc("/addtocart", addToCart)
+	http.HandleFunc("/addtocart", requireCartOwner(addToCart))
+	http.HandleFunc("GET /cart", requireCartOwner(getCart))
+	http.HandleFunc("DELETE /cart", requireCartOwner(clearCart))
+	http.HandleFunc("POST /cart/items", requireCartOwner(addToCart))
+	http.HandleFunc("PATCH /cart/items/{productId}", requireCartOwner(updateCartItem))
+	http.HandleFunc("DELETE /cart/items/{productId}", requireCartOwner(removeCartItem))
+	http.HandleFunc("POST /cart/merge", auth.RequireAuth(mergeGuestCart))
+	http.HandleFunc("GET /products", listProducts)
+	http.HandleFunc("GET /products/search", searchProducts)
+	http.HandleFunc("GET /products/{id}", getProduct)
+	http.HandleFunc("PUT /products/{id}/price", auth.RequireRole(setProductPrice, auth.RolePharmacist, auth.RoleAdmin))
+	http.HandleFunc("GET /categories", listCategories)
+
+	// The cart page is served by placeorderservice.
+	corsHandler := handlers.CORS(
+		handlers.AllowedOrigins([]string{"http://localhost:9003"}),
+		handlers.AllowedMethods([]string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
+		handlers.AllowCredentials(),
+	)(http.DefaultServeMux)
 
 	fmt.Printf("Starting server at port 9001\n")
-	log.Fatal(http.ListenAndServe(":9001", nil))
+	log.Fatal(http.ListenAndServe(":9001", corsHandler))
 }
 
 func InitDB() error {
@@ -68,60 +131,3 @@ func InitDB() error {
 	log.Println("Successfully connected to the database")
 	return nil
 }
-
-func addToCart(w http.ResponseWriter, r *http.Request) {
-	log.Print("addtocart invoked")
-
-	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	userIDCookie, err := r.Cookie("userID")
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	userID, err := strconv.Atoi(userIDCookie.Value)
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
-	}
-
-	var item CartItem
-	err = json.NewDecoder(r.Body).Decode(&item)
-	if err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
-	}
-
-	mu.Lock()
-	defer mu.Unlock()
-
-	var availableQuantity int
-	err = db.QueryRow("SELECT quantity FROM products WHERE id = $1 FOR UPDATE", item.ProductID).Scan(&availableQuantity)
-	if err != nil {
-		log.Printf("Product not found or error fetching quantity: %v", err)
-		http.Error(w, "Product not found", http.StatusNotFound)
-		return
-	}
-
-	if availableQuantity < item.Quantity {
-		log.Printf("Not enough stock available: requested %d, available %d", item.Quantity, availableQuantity)
-		http.Error(w, "Not enough stock available", http.StatusConflict)
-		return
-	}
-
-	_, err = db.Exec("INSERT INTO cart (user_id, product_id, quantity) VALUES ($1, $2, $3)", userID, item.ProductID, item.Quantity)
-	if err != nil {
-		log.Printf("Failed to add item to cart: %v", err)
-		http.Error(w, "Failed to add item to cart", http.StatusInternalServerError)
-		return
-	}
-
-	log.Printf("Successfully added item to cart for user %d", userID)
-	response := map[string]string{"message": "Item successfully added to cart"}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"shared/stock"
+)
+
+// Carts reserve the stock they hold in stock_reservations, defined by the
+// shared stock package, until RESERVATION_TTL has passed.
+var (
+	reservationTTL = 15 * time.Minute
+
+	// sweepInterval is how often expired reservations are released.
+	sweepInterval = time.Minute
+)
+
+func initReservations() error {
+	if ttl := os.Getenv("RESERVATION_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid RESERVATION_TTL %q", ttl)
+		}
+		reservationTTL = d
+	}
+
+	if interval := os.Getenv("RESERVATION_SWEEP_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid RESERVATION_SWEEP_INTERVAL %q", interval)
+		}
+		sweepInterval = d
+	}
+
+	return stock.Init(db)
+}
+
+// sweepReservations releases expired cart reservations every
+// sweepInterval. The cart lines stay, but no longer hold any stock.
+func sweepReservations() {
+	for range time.Tick(sweepInterval) {
+		res, err := db.Exec("DELETE FROM stock_reservations WHERE order_id IS NULL AND expires_at <= NOW()")
+		if err != nil {
+			log.Printf("Error releasing expired reservations: %v", err)
+			continue
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			log.Printf("Released %d expired reservations", n)
+		}
+	}
+}
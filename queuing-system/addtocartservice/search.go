@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"shared/stock"
+)
+
+// Search matches the query against product names and generic names by
+// trigram similarity, so misspellings such as "ibuprofin" still match, and
+// against name, generic name and description by full-text search. Before
+// matching, the query is expanded with its entries in drug_synonyms, so a
+// search for "paracetamol" also finds products sold as acetaminophen. The
+// synonyms table is created by shared/synonyms.
+const searchSchema = `
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+	setweight(to_tsvector('english', name), 'A') ||
+	setweight(to_tsvector('english', generic_name), 'A') ||
+	setweight(to_tsvector('english', description), 'C')
+) STORED;
+CREATE INDEX IF NOT EXISTS products_search_vector_idx ON products USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS products_name_trgm_idx ON products USING GIN (name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS products_generic_name_trgm_idx ON products USING GIN (generic_name gin_trgm_ops);`
+
+// searchQuery ranks products against $1 and every term related to it
+// through drug_synonyms. A term is related if it shares its canonical name
+// with $1, where $1 itself may be slightly misspelled. Each product is
+// ranked by its best match over all terms. A product is in stock if it has
+// stock available to promise, as the cart counts it.
+var searchQuery = `
+WITH query AS (
+	SELECT LOWER($1) AS term
+), canonical AS (
+	SELECT s.canonical FROM drug_synonyms s, query q WHERE s.term % q.term
+	UNION
+	SELECT s.canonical FROM drug_synonyms s, query q WHERE s.canonical % q.term
+), terms AS (
+	SELECT term FROM query
+	UNION
+	SELECT canonical FROM canonical
+	UNION
+	SELECT s.term FROM drug_synonyms s JOIN canonical c ON c.canonical = s.canonical
+), matches AS (
+	SELECT p.id, MAX(GREATEST(
+		ts_rank(p.search_vector, plainto_tsquery('english', t.term)),
+		word_similarity(t.term, p.name),
+		word_similarity(t.term, p.generic_name)
+	)) AS rank
+	FROM products p CROSS JOIN terms t
+	WHERE p.search_vector @@ plainto_tsquery('english', t.term)
+		OR t.term % p.name OR t.term <% p.name
+		OR t.term % p.generic_name OR t.term <% p.generic_name
+	GROUP BY p.id
+)
+SELECT p.id, p.name, p.generic_name, p.description, p.category, p.image_url, p.price_cents, p.quantity,
+	p.prescription_required, m.rank, ` + stock.Available("p.id", "0") + `, COUNT(*) OVER ()
+FROM matches m JOIN products p ON p.id = m.id
+WHERE $2 = '' OR LOWER(p.category) = LOWER($2)
+ORDER BY m.rank DESC, p.name, p.id
+LIMIT $3 OFFSET $4`
+
+// SearchResult is a product matching a search, with how well it matched.
+type SearchResult struct {
+	Product
+	Rank    float64 `json:"rank"`
+	InStock bool    `json:"in_stock"`
+}
+
+type SearchPage struct {
+	Products []SearchResult `json:"products"`
+	Page     int            `json:"page"`
+	PageSize int            `json:"page_size"`
+	Total    int            `json:"total"`
+}
+
+func initSearch() error {
+	_, err := db.Exec(searchSchema)
+	if err != nil {
+		return fmt.Errorf("error creating search index: %w", err)
+	}
+	return nil
+}
+
+// searchProducts returns a page of the products matching q, best match
+// first, optionally narrowed to a category.
+func searchProducts(w http.ResponseWriter, r *http.Request) {
+	log.Print("searchProducts invoked")
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, "Missing q parameter", http.StatusBadRequest)
+		return
+	}
+
+	page, pageSize, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	category := strings.TrimSpace(r.URL.Query().Get("category"))
+
+	rows, err := db.Query(searchQuery, q, category, pageSize, (page-1)*pageSize)
+	if err != nil {
+		log.Printf("Error searching products for %q: %v", q, err)
+		http.Error(w, "Error searching products", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	result := SearchPage{Products: []SearchResult{}, Page: page, PageSize: pageSize}
+	for rows.Next() {
+		var res SearchResult
+		var available int
+		p := &res.Product
+		err := rows.Scan(&p.ID, &p.Name, &p.GenericName, &p.Description, &p.Category, &p.ImageURL,
+			&p.PriceCents, &p.Quantity, &p.PrescriptionRequired, &res.Rank, &available, &result.Total)
+		if err != nil {
+			log.Printf("Error scanning search result: %v", err)
+			http.Error(w, "Error searching products", http.StatusInternalServerError)
+			return
+		}
+		res.InStock = available > 0
+		result.Products = append(result.Products, res)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// smtpNotifier sends email through the server at SMTP_HOST:SMTP_PORT,
+// logging in with SMTP_USERNAME and SMTP_PASSWORD if they are set.
+type smtpNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func newSMTPNotifier() (*smtpNotifier, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, errors.New("SMTP_HOST is not set")
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		return nil, errors.New("SMTP_FROM is not set")
+	}
+
+	s := &smtpNotifier{addr: net.JoinHostPort(host, port), from: from}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		s.auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return s, nil
+}
+
+func (s *smtpNotifier) Notify(n Notification, address string) error {
+	if address == "" {
+		return errors.New("no email address")
+	}
+
+	msg, err := mimeMessage(s.from, address, n)
+	if err != nil {
+		return err
+	}
+
+	err = smtp.SendMail(s.addr, s.auth, s.from, []string{address}, msg)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Email sent successfully to: %s", address)
+	return nil
+}
+
+// mimeMessage builds an email of the notification, with both its text and
+// its HTML as multipart/alternative if it has HTML. from may be empty for
+// senders that fill it in.
+func mimeMessage(from, to string, n Notification) ([]byte, error) {
+	var msg bytes.Buffer
+	if from != "" {
+		fmt.Fprintf(&msg, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", n.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if n.Locale != "" {
+		fmt.Fprintf(&msg, "Content-Language: %s\r\n", n.Locale)
+	}
+	msg.WriteString("MIME-Version: 1.0\r\n")
+
+	if n.HTMLBody == "" {
+		msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+		msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		err := writeQuotedPrintable(&msg, n.Body)
+		return msg.Bytes(), err
+	}
+
+	mw := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", mw.Boundary())
+
+	// Clients show the last part they understand, so HTML goes last.
+	parts := []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", n.Body},
+		{"text/html; charset=UTF-8", n.HTMLBody},
+	}
+	for _, part := range parts {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(pw, part.body); err != nil {
+			return nil, err
+		}
+	}
+
+	err := mw.Close()
+	return msg.Bytes(), err
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// smsGatewayNotifier sends text messages through an HTTP SMS gateway. The
+// message is POSTed as JSON to SMS_GATEWAY_URL with SMS_GATEWAY_TOKEN as a
+// bearer token, from the sender SMS_FROM.
+type smsGatewayNotifier struct {
+	url    string
+	token  string
+	from   string
+	client *http.Client
+}
+
+func newSMSGatewayNotifier() (*smsGatewayNotifier, error) {
+	url := os.Getenv("SMS_GATEWAY_URL")
+	if url == "" {
+		return nil, errors.New("SMS_GATEWAY_URL is not set")
+	}
+	return &smsGatewayNotifier{
+		url:    url,
+		token:  os.Getenv("SMS_GATEWAY_TOKEN"),
+		from:   os.Getenv("SMS_FROM"),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *smsGatewayNotifier) Notify(n Notification, address string) error {
+	if address == "" {
+		return errors.New("no phone number")
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"to":      address,
+		"from":    s.from,
+		"message": n.Subject + "\n\n" + n.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	err = post(s.client, req)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Text message sent successfully to: %s", address)
+	return nil
+}
+
+// webhookNotifier POSTs notifications as JSON to the customer's URL, or to
+// WEBHOOK_URL for customers who have not given one. If WEBHOOK_SECRET is
+// set, the body is signed with it in the X-Signature header as a hex
+// HMAC-SHA256, so receivers can check it came from here.
+//
+// Customers' URLs were checked to be public when they were set, but their
+// hosts may have been pointed elsewhere since, so they are only ever
+// connected to at public addresses. WEBHOOK_URL is trusted.
+type webhookNotifier struct {
+	url          string
+	secret       []byte
+	client       *http.Client
+	publicClient *http.Client
+}
+
+func newWebhookNotifier() (*webhookNotifier, error) {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("webhook address %s is not public", host)
+			}
+			return nil
+		},
+	}
+
+	return &webhookNotifier{
+		url:    os.Getenv("WEBHOOK_URL"),
+		secret: []byte(os.Getenv("WEBHOOK_SECRET")),
+		client: &http.Client{Timeout: 30 * time.Second},
+		publicClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+	}, nil
+}
+
+// publicIP reports whether ip is an address on the public internet.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+func (wh *webhookNotifier) Notify(n Notification, address string) error {
+	client := wh.publicClient
+	if address == "" {
+		address, client = wh.url, wh.client
+	}
+	if address == "" {
+		return errors.New("no webhook URL")
+	}
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, address, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(wh.secret) > 0 {
+		mac := hmac.New(sha256.New, wh.secret)
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	err = post(client, req)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Webhook %s delivered to: %s", n.Event, address)
+	return nil
+}
+
+// post sends req and fails unless it gets a 2xx response.
+func post(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// fileNotifier appends notifications to NOTIFIER_FILE, by default
+// notifications.log, one JSON object per line.
+type fileNotifier struct {
+	channel string
+	mu      *sync.Mutex
+	f       *os.File
+}
+
+// All file notifiers share one file.
+var (
+	notificationFileMu sync.Mutex
+	notificationFile   *os.File
+)
+
+func newFileNotifier(channel string) (*fileNotifier, error) {
+	notificationFileMu.Lock()
+	defer notificationFileMu.Unlock()
+
+	if notificationFile == nil {
+		path := os.Getenv("NOTIFIER_FILE")
+		if path == "" {
+			path = "notifications.log"
+		}
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		notificationFile = f
+	}
+	return &fileNotifier{channel: channel, mu: &notificationFileMu, f: notificationFile}, nil
+}
+
+func (fn *fileNotifier) Notify(n Notification, address string) error {
+	line, err := json.Marshal(struct {
+		Time    time.Time `json:"time"`
+		Channel string    `json:"channel"`
+		Address string    `json:"address"`
+		Notification
+	}{time.Now(), fn.channel, address, n})
+	if err != nil {
+		return err
+	}
+
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	_, err = fn.f.Write(append(line, '\n'))
+	return err
+}
+
+// consoleNotifier writes notifications to the log.
+type consoleNotifier struct {
+	channel string
+}
+
+func (c consoleNotifier) Notify(n Notification, address string) error {
+	log.Printf("%s notification %s to %q: %s\n%s", c.channel, n.Event, address, n.Subject, n.Body)
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// The Gmail notifier sends as the account that authorised it. The client
+// secret is read from credentials.json and the account's token from
+// token.json, which is written by running the service once with
+// -gmail-authorize.
+const (
+	gmailCredentialsFile = "credentials.json"
+	gmailTokenFile       = "token.json"
+)
+
+type gmailNotifier struct {
+	srv *gmail.Service
+}
+
+func gmailConfig() (*oauth2.Config, error) {
+	b, err := os.ReadFile(gmailCredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client secret file: %w", err)
+	}
+
+	config, err := google.ConfigFromJSON(b, gmail.GmailSendScope)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse client secret file to config: %w", err)
+	}
+	return config, nil
+}
+
+func newGmailNotifier() (*gmailNotifier, error) {
+	config, err := gmailConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := tokenFromFile(gmailTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s, run with -gmail-authorize to create it: %w", gmailTokenFile, err)
+	}
+
+	ctx := context.Background()
+	srv, err := gmail.NewService(ctx, option.WithHTTPClient(config.Client(ctx, tok)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve Gmail client: %w", err)
+	}
+	return &gmailNotifier{srv: srv}, nil
+}
+
+func (g *gmailNotifier) Notify(n Notification, address string) error {
+	if address == "" {
+		return fmt.Errorf("no email address")
+	}
+
+	email, err := mimeMessage("", address, n)
+	if err != nil {
+		return err
+	}
+
+	var message gmail.Message
+	message.Raw = base64.URLEncoding.EncodeToString(email)
+
+	_, err = g.srv.Users.Messages.Send("me", &message).Do()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Email sent successfully to: %s", address)
+	return nil
+}
+
+// authorizeGmail asks the account to authorise sending at the terminal and
+// saves its token for newGmailNotifier.
+func authorizeGmail() error {
+	config, err := gmailConfig()
+	if err != nil {
+		return err
+	}
+
+	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+	fmt.Printf("Go to the following link in your browser then type the authorization code: \n%v\n", authURL)
+
+	var authCode string
+	if _, err := fmt.Scan(&authCode); err != nil {
+		return fmt.Errorf("unable to read authorization code: %w", err)
+	}
+
+	tok, err := config.Exchange(context.Background(), authCode)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve token from web: %w", err)
+	}
+	return saveToken(gmailTokenFile, tok)
+}
+
+func tokenFromFile(file string) (*oauth2.Token, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tok := &oauth2.Token{}
+	err = json.NewDecoder(f).Decode(tok)
+	return tok, err
+}
+
+func saveToken(path string, token *oauth2.Token) error {
+	fmt.Printf("Saving credential file to: %s\n", path)
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("unable to cache oauth token: %w", err)
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(token)
+}
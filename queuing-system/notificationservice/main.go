@@ -1,43 +1,153 @@
 package main
 
 import (
-	"context"
-	"encoding/base64"
+	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/gmail/v1"
+	_ "github.com/lib/pq"
+
+	"shared/auth"
+	"shared/idempotency"
+	"shared/messaging"
 )
 
+var db *sql.DB
+
+// Amounts are in cents.
 type Order struct {
-	UserID  int       `json:"user_id"`
-	EmailID string    `json:"email_id"`
-	Cart    []CartItem `json:"cart"`
+	OrderID       string    `json:"order_id"`
+	UserID        int       `json:"user_id"`
+	EmailID       string    `json:"email_id"`
+	Cart          []CartItem `json:"cart"`
+	SubtotalCents int64     `json:"subtotal_cents"`
+	TaxCents      int64     `json:"tax_cents"`
+	TotalCents    int64     `json:"total_cents"`
+
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a drug interaction found in the order by the
+// orchestrator.
+type Interaction struct {
+	DrugA       string `json:"drug_a"`
+	DrugB       string `json:"drug_b"`
+	Severity    string `json:"severity"`
+	Description string `json:"description"`
 }
 
 type CartItem struct {
-	ProductID int `json:"product_id"`
-	Quantity  int `json:"quantity"`
+	ProductID      int   `json:"product_id"`
+	Quantity       int   `json:"quantity"`
+	UnitPriceCents int64 `json:"unit_price_cents"`
+	LineTotalCents int64 `json:"line_total_cents"`
 }
 
 func main() {
+	gmailAuthorize := flag.Bool("gmail-authorize", false, "authorise the Gmail account to send notifications and exit")
+	flag.Parse()
+
+	if *gmailAuthorize {
+		err := authorizeGmail()
+		if err != nil {
+			log.Fatalf("Error authorising Gmail: %v", err)
+		}
+		return
+	}
+
 	err := godotenv.Load(".env")
 	if err != nil {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
 
-	http.HandleFunc("/notify", notificationHandler)
+	err = InitDB()
+	if err != nil {
+		log.Fatalf("Error initializing database: %v", err)
+	}
+
+	err = auth.Init(db)
+	if err != nil {
+		log.Fatalf("Error initializing auth: %v", err)
+	}
+
+	err = idempotency.Init(db, "notificationservice")
+	if err != nil {
+		log.Fatalf("Error initializing idempotency store: %v", err)
+	}
+
+	err = initPreferences()
+	if err != nil {
+		log.Fatalf("Error initializing notification preferences: %v", err)
+	}
+
+	err = initNotifiers()
+	if err != nil {
+		log.Fatalf("Error initializing notifiers: %v", err)
+	}
+
+	err = initTemplates()
+	if err != nil {
+		log.Fatalf("Error initializing templates: %v", err)
+	}
+
+	// Messages are only sent at the request of the service whose event
+	// they are about, never by customers themselves.
+	http.HandleFunc("/notify", auth.RequireService(idempotency.Wrap(notificationHandler), "orchestrator"))
+	http.HandleFunc("/cancel", auth.RequireService(idempotency.Wrap(cancellationHandler), "orchestrator"))
+	http.HandleFunc("/recall", auth.RequireService(idempotency.Wrap(recallHandler), "removedb"))
+	http.HandleFunc("/payment-failed", auth.RequireService(idempotency.Wrap(paymentFailedHandler), "orchestrator"))
+	http.HandleFunc("/refill-reminder", auth.RequireService(idempotency.Wrap(refillReminderHandler), "prescriptionservice"))
+	http.HandleFunc("GET /preferences", auth.RequireAuth(getPreferences))
+	http.HandleFunc("GET /preferences/locale", auth.RequireAuth(getLocale))
+	http.HandleFunc("PUT /preferences/locale", auth.RequireAuth(setLocale))
+	http.HandleFunc("PUT /preferences/{channel}", auth.RequireAuth(setPreference))
+
+	if url := os.Getenv("AMQP_URL"); url != "" {
+		broker, err := messaging.NewAMQPBroker(url)
+		if err != nil {
+			log.Fatalf("Error connecting to message broker: %v", err)
+		}
+		defer broker.Close()
+
+		err = messaging.Serve(broker, "notification.requests", http.DefaultServeMux)
+		if err != nil {
+			log.Fatalf("Error consuming requests: %v", err)
+		}
+	}
 
 	fmt.Println("Starting notification service at port 8004")
 	log.Fatal(http.ListenAndServe(":8004", nil))
 }
 
+func InitDB() error {
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("DB_HOST"),
+		os.Getenv("DB_PORT"),
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_PASSWORD"),
+		os.Getenv("DB_NAME"))
+
+	var err error
+	db, err = sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("error connecting to the database: %w", err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return fmt.Errorf("error pinging the database: %w", err)
+	}
+
+	log.Println("Successfully connected to the database")
+	return nil
+}
+
 func notificationHandler(w http.ResponseWriter, r *http.Request) {
 	log.Print("notificationHandler invoked")
 
@@ -53,108 +163,188 @@ func notificationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = sendEmail(order)
-	if err != nil {
-		http.Error(w, "Failed to send email", http.StatusInternalServerError)
+	if !forCurrentUser(w, r, order.UserID) {
 		return
 	}
 
-	response := map[string]string{
-		"message": "Notification sent successfully",
-	}
+	log.Printf("Sending confirmation for order %s", order.OrderID)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	view := orderView(order)
+	send(w, "order_confirmed", "order_confirmation", order.UserID, order.EmailID,
+		TemplateData{Order: &view}, order, "Notification sent successfully")
 }
 
-func sendEmail(order Order) error {
-	ctx := context.Background()
+// cancellationHandler tells the customer that an order they were already
+// told about has been cancelled. It compensates notificationHandler.
+func cancellationHandler(w http.ResponseWriter, r *http.Request) {
+	log.Print("cancellationHandler invoked")
 
-	b, err := os.ReadFile("credentials.json")
-	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
 	}
 
-	config, err := google.ConfigFromJSON(b, gmail.GmailSendScope)
+	var order Order
+	err := json.NewDecoder(r.Body).Decode(&order)
 	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
 	}
 
-	client := getClient(ctx, config)
+	if !forCurrentUser(w, r, order.UserID) {
+		return
+	}
+
+	log.Printf("Sending cancellation notice for order %s", order.OrderID)
+
+	view := orderView(order)
+	send(w, "order_cancelled", "order_cancelled", order.UserID, order.EmailID,
+		TemplateData{Order: &view}, order, "Cancellation notice sent successfully")
+}
+
+// PaymentFailure is sent by the orchestrator when an order could not be
+// paid for.
+type PaymentFailure struct {
+	Order
+	Reason string `json:"reason"`
+}
+
+func paymentFailedHandler(w http.ResponseWriter, r *http.Request) {
+	log.Print("paymentFailedHandler invoked")
 
-	srv, err := gmail.New(client)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var failure PaymentFailure
+	err := json.NewDecoder(r.Body).Decode(&failure)
 	if err != nil {
-		log.Fatalf("Unable to retrieve Gmail client: %v", err)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
 	}
 
-	var message gmail.Message
-	emailTo := order.EmailID
-	subject := "Order Confirmation"
-	body := fmt.Sprintf("Dear user,\n\nYour order has been confirmed.\n\nOrder Details:\n")
-	for _, item := range order.Cart {
-		body += fmt.Sprintf("Product ID: %d, Quantity: %d\n", item.ProductID, item.Quantity)
+	if !forCurrentUser(w, r, failure.UserID) {
+		return
 	}
-	body += "\nThank you for your purchase!"
 
-	email := []byte("To: " + emailTo + "\r\n" +
-		"Subject: " + subject + "\r\n" +
-		"\r\n" + body + "\r\n")
+	log.Printf("Sending payment failure notice for order %s", failure.OrderID)
 
-	message.Raw = base64.URLEncoding.EncodeToString(email)
+	view := orderView(failure.Order)
+	send(w, "payment_failed", "payment_failed", failure.UserID, failure.EmailID,
+		TemplateData{Order: &view, Reason: failure.Reason}, failure, "Payment failure notice sent successfully")
+}
 
-	_, err = srv.Users.Messages.Send("me", &message).Do()
-	if err != nil {
-		log.Printf("Error sending email: %v", err)
-		return err
+// RefillReminder reminds a customer that a prescription of theirs can be
+// refilled before it expires.
+type RefillReminder struct {
+	UserID         int       `json:"user_id"`
+	EmailID        string    `json:"email_id"`
+	PrescriptionID int       `json:"prescription_id"`
+	ProductID      int       `json:"product_id"`
+	ProductName    string    `json:"product_name"`
+	FillsRemaining int       `json:"fills_remaining"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+func refillReminderHandler(w http.ResponseWriter, r *http.Request) {
+	log.Print("refillReminderHandler invoked")
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
 	}
 
-	log.Printf("Email sent successfully to: %s", emailTo)
-	return nil
-}
+	var reminder RefillReminder
+	err := json.NewDecoder(r.Body).Decode(&reminder)
+	if err != nil || reminder.EmailID == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
 
-func getClient(ctx context.Context, config *oauth2.Config) *http.Client {
-	tokFile := "token.json"
-	tok, err := tokenFromFile(tokFile)
-	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
+	if !forCurrentUser(w, r, reminder.UserID) {
+		return
 	}
-	return config.Client(ctx, tok)
+
+	log.Printf("Sending refill reminder for prescription %d", reminder.PrescriptionID)
+
+	send(w, "refill_reminder", "refill_reminder", reminder.UserID, reminder.EmailID,
+		TemplateData{Reminder: &reminder}, reminder, "Refill reminder sent successfully")
 }
 
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
-	return tok, err
+// RecallNotice tells a customer that a product they were sold has been
+// recalled. It is sent by removedb.
+type RecallNotice struct {
+	RecallID     int      `json:"recall_id"`
+	OrderID      string   `json:"order_id"`
+	UserID       int      `json:"user_id"`
+	EmailID      string   `json:"email_id"`
+	ProductID    int      `json:"product_id"`
+	ProductName  string   `json:"product_name"`
+	BatchNumbers []string `json:"batch_numbers"`
+	Quantity     int      `json:"quantity"`
+	Reason       string   `json:"reason"`
 }
 
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the authorization code: \n%v\n", authURL)
+func recallHandler(w http.ResponseWriter, r *http.Request) {
+	log.Print("recallHandler invoked")
 
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code: %v", err)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
 	}
 
-	tok, err := config.Exchange(context.Background(), authCode)
-	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
+	var notice RecallNotice
+	err := json.NewDecoder(r.Body).Decode(&notice)
+	if err != nil || notice.EmailID == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if !forCurrentUser(w, r, notice.UserID) {
+		return
+	}
+
+	log.Printf("Sending notice of recall %d for order %s", notice.RecallID, notice.OrderID)
+
+	if notice.ProductName == "" {
+		notice.ProductName = fmt.Sprintf("#%d", notice.ProductID)
 	}
-	return tok
+	send(w, "product_recall", "recall_notice", notice.UserID, notice.EmailID,
+		TemplateData{Recall: &notice}, notice, "Recall notice sent successfully")
 }
 
-func saveToken(path string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.Create(path)
+// forCurrentUser checks that a message is addressed to the user the calling
+// service's token was issued for.
+func forCurrentUser(w http.ResponseWriter, r *http.Request, userID int) bool {
+	if userID != auth.CurrentUser(r).ID {
+		http.Error(w, "Message user does not match the authenticated user", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// send renders the message for the user, sends it and responds with sent.
+// data is the payload the message is about, passed on to webhooks.
+func send(w http.ResponseWriter, event, message string, userID int, email string, templateData TemplateData, data any, sent string) {
+	n, err := compose(event, message, userID, email, templateData)
+	if err != nil {
+		log.Printf("Error composing %s: %v", message, err)
+		http.Error(w, "Failed to send notification", http.StatusInternalServerError)
+		return
+	}
+	n.Data = data
+
+	err = notify(n)
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		http.Error(w, "Failed to send notification", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{
+		"message": sent,
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Notification is a message to one customer.
+type Notification struct {
+	// Event names what happened, for webhooks and logs, such as
+	// order_confirmed.
+	Event   string `json:"event"`
+	UserID  int    `json:"user_id"`
+	Email   string `json:"-"`
+	Locale  string `json:"locale"`
+	Subject string `json:"subject"`
+
+	// Body is the plain text of the message and HTMLBody the same as
+	// HTML, for channels that can show it.
+	Body     string `json:"body"`
+	HTMLBody string `json:"html_body,omitempty"`
+
+	// Data is the order or notice the notification is about.
+	Data any `json:"data,omitempty"`
+}
+
+// A Notifier delivers notifications over one channel. address is where
+// the customer is reached on that channel: an email address, a phone
+// number or a URL.
+type Notifier interface {
+	Notify(n Notification, address string) error
+}
+
+// Channels notifications can be sent over.
+const (
+	channelEmail   = "email"
+	channelSMS     = "sms"
+	channelWebhook = "webhook"
+)
+
+var channels = []string{channelEmail, channelSMS, channelWebhook}
+
+// notifiers holds the notifier of every channel that is configured.
+var notifiers = make(map[string]Notifier)
+
+// initNotifiers sets up the notifier of each channel from
+// <CHANNEL>_NOTIFIER:
+//
+//   - email: gmail (the default), smtp, file, console or none,
+//   - sms: http, for an SMS gateway, file, console or none (the default),
+//   - webhook: http, file, console or none (the default).
+//
+// file and console notifiers deliver nothing, so the service can be run
+// locally without any network access.
+func initNotifiers() error {
+	defaults := map[string]string{channelEmail: "gmail", channelSMS: "none", channelWebhook: "none"}
+
+	for _, channel := range channels {
+		kind := os.Getenv(strings.ToUpper(channel) + "_NOTIFIER")
+		if kind == "" {
+			kind = defaults[channel]
+		}
+
+		notifier, err := newNotifier(channel, kind)
+		if err != nil {
+			return fmt.Errorf("error setting up %s notifier: %w", channel, err)
+		}
+		if notifier == nil {
+			continue
+		}
+		notifiers[channel] = notifier
+		log.Printf("Sending %s notifications with the %s notifier", channel, kind)
+	}
+
+	if len(notifiers) == 0 {
+		return errors.New("no notification channel is configured")
+	}
+	return nil
+}
+
+func newNotifier(channel, kind string) (Notifier, error) {
+	switch {
+	case kind == "none":
+		return nil, nil
+	case kind == "file":
+		return newFileNotifier(channel)
+	case kind == "console":
+		return consoleNotifier{channel: channel}, nil
+	case channel == channelEmail && kind == "gmail":
+		return newGmailNotifier()
+	case channel == channelEmail && kind == "smtp":
+		return newSMTPNotifier()
+	case channel == channelSMS && kind == "http":
+		return newSMSGatewayNotifier()
+	case channel == channelWebhook && kind == "http":
+		return newWebhookNotifier()
+	}
+	return nil, fmt.Errorf("unknown notifier %q", kind)
+}
+
+// notify sends the notification over every channel the customer has
+// turned on that is configured here; customers without preferences get
+// email. Every customer gets at least one notification: if none of their
+// channels can be used, it goes to their email address. notify fails only
+// if nothing could be delivered.
+func notify(n Notification) error {
+	preferences, err := loadPreferences(n.UserID)
+	if err != nil {
+		log.Printf("Error loading notification preferences of user %d, using email: %v", n.UserID, err)
+		preferences = nil
+	}
+
+	var attempted, delivered int
+	var errs []error
+	for _, channel := range channels {
+		notifier, ok := notifiers[channel]
+		if !ok {
+			continue
+		}
+
+		preference, ok := preferences[channel]
+		if !ok {
+			preference = Preference{Channel: channel, Enabled: channel == channelEmail}
+		}
+		if !preference.Enabled {
+			continue
+		}
+
+		address := preference.Address
+		if address == "" && channel == channelEmail {
+			address = n.Email
+		}
+
+		attempted++
+		err := notifier.Notify(n, address)
+		if err != nil {
+			log.Printf("Error sending %s notification %s to user %d: %v", channel, n.Event, n.UserID, err)
+			errs = append(errs, fmt.Errorf("%s: %w", channel, err))
+			continue
+		}
+		delivered++
+	}
+
+	if attempted == 0 {
+		notifier, ok := notifiers[channelEmail]
+		if !ok {
+			return fmt.Errorf("user %d has no usable notification channel", n.UserID)
+		}
+		return notifier.Notify(n, n.Email)
+	}
+	if delivered == 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"shared/auth"
+)
+
+// notification_preferences holds the channels each customer wants to be
+// notified over. A customer without a row for a channel gets email only.
+// An email preference without an address sends to the address of the
+// customer's account. The language customers are written to in is their
+// locale in users, which userservice sets at registration.
+const preferenceSchema = `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale TEXT;
+CREATE TABLE IF NOT EXISTS notification_preferences (
+	user_id INTEGER NOT NULL,
+	channel TEXT NOT NULL,
+	address TEXT NOT NULL DEFAULT '',
+	enabled BOOLEAN NOT NULL,
+	updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (user_id, channel)
+);`
+
+type Preference struct {
+	Channel string `json:"channel"`
+	Address string `json:"address"`
+	Enabled bool   `json:"enabled"`
+
+	// Available reports whether the channel is configured here at all.
+	Available bool `json:"available"`
+}
+
+// phoneNumber is an E.164 phone number, as SMS gateways expect.
+var phoneNumber = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+func initPreferences() error {
+	_, err := db.Exec(preferenceSchema)
+	if err != nil {
+		return fmt.Errorf("error creating notification preferences table: %w", err)
+	}
+	return nil
+}
+
+// loadPreferences returns the preferences the user has set, by channel.
+func loadPreferences(userID int) (map[string]Preference, error) {
+	rows, err := db.Query("SELECT channel, address, enabled FROM notification_preferences WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	preferences := make(map[string]Preference)
+	for rows.Next() {
+		var p Preference
+		if err := rows.Scan(&p.Channel, &p.Address, &p.Enabled); err != nil {
+			return nil, err
+		}
+		preferences[p.Channel] = p
+	}
+	return preferences, rows.Err()
+}
+
+// validAddress checks that address can be used on the channel. Empty
+// addresses are allowed where the channel has a fallback. Webhooks must be
+// https URLs of hosts on the public internet, so that customers cannot
+// point them at this network.
+func validAddress(channel, address string) bool {
+	switch channel {
+	case channelEmail:
+		if address == "" {
+			return true
+		}
+		_, err := mail.ParseAddress(address)
+		return err == nil
+	case channelSMS:
+		return phoneNumber.MatchString(address)
+	case channelWebhook:
+		if address == "" {
+			return true
+		}
+		u, err := url.Parse(address)
+		if err != nil || u.Scheme != "https" || u.Hostname() == "" || u.User != nil {
+			return false
+		}
+		ips, err := net.LookupIP(u.Hostname())
+		if err != nil || len(ips) == 0 {
+			return false
+		}
+		for _, ip := range ips {
+			if !publicIP(ip) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// getPreferences returns the user's preference for every channel, filling
+// in the defaults for channels they have not set.
+func getPreferences(w http.ResponseWriter, r *http.Request) {
+	log.Print("getPreferences invoked")
+
+	set, err := loadPreferences(auth.CurrentUser(r).ID)
+	if err != nil {
+		log.Printf("Error loading notification preferences: %v", err)
+		http.Error(w, "Error fetching preferences", http.StatusInternalServerError)
+		return
+	}
+
+	preferences := []Preference{}
+	for _, channel := range channels {
+		p, ok := set[channel]
+		if !ok {
+			p = Preference{Channel: channel, Enabled: channel == channelEmail}
+		}
+		_, p.Available = notifiers[channel]
+		preferences = append(preferences, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preferences)
+}
+
+// setPreference turns a channel on or off for the user and sets where they
+// are reached on it.
+func setPreference(w http.ResponseWriter, r *http.Request) {
+	log.Print("setPreference invoked")
+
+	channel := r.PathValue("channel")
+	if !slices.Contains(channels, channel) {
+		http.Error(w, "Unknown channel", http.StatusNotFound)
+		return
+	}
+
+	var p Preference
+	err := json.NewDecoder(r.Body).Decode(&p)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	p.Channel = channel
+
+	if (p.Enabled || p.Address != "") && !validAddress(channel, p.Address) {
+		http.Error(w, fmt.Sprintf("Invalid %s address", channel), http.StatusBadRequest)
+		return
+	}
+
+	userID := auth.CurrentUser(r).ID
+	_, err = db.Exec(`INSERT INTO notification_preferences (user_id, channel, address, enabled) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, channel) DO UPDATE SET address = EXCLUDED.address, enabled = EXCLUDED.enabled, updated_at = NOW()`,
+		userID, channel, p.Address, p.Enabled)
+	if err != nil {
+		log.Printf("Error saving %s preference of user %d: %v", channel, userID, err)
+		http.Error(w, "Error saving preference", http.StatusInternalServerError)
+		return
+	}
+
+	_, p.Available = notifiers[channel]
+	log.Printf("User %d set %s notifications enabled=%t", userID, channel, p.Enabled)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func writeLocale(w http.ResponseWriter, locale string) {
+	response := map[string]any{
+		"locale":    locale,
+		"effective": matchLocale(locale),
+		"available": locales(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// getLocale returns the user's locale, the locale they are actually
+// written to in and the locales there are templates for.
+func getLocale(w http.ResponseWriter, r *http.Request) {
+	log.Print("getLocale invoked")
+	writeLocale(w, userLocale(auth.CurrentUser(r).ID))
+}
+
+// setLocale sets the locale the user is written to in. Only locales there
+// are templates for, or whose base language has templates, are accepted.
+func setLocale(w http.ResponseWriter, r *http.Request) {
+	log.Print("setLocale invoked")
+
+	var request struct {
+		Locale string `json:"locale"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	locale := strings.ToLower(strings.ReplaceAll(request.Locale, "_", "-"))
+	base, _, _ := strings.Cut(locale, "-")
+	_, supported := templates[locale]
+	_, baseSupported := templates[base]
+	if !supported && !baseSupported {
+		http.Error(w, "Unsupported locale", http.StatusBadRequest)
+		return
+	}
+
+	userID := auth.CurrentUser(r).ID
+	_, err = db.Exec("UPDATE users SET locale = $1 WHERE id = $2", locale, userID)
+	if err != nil {
+		log.Printf("Error saving locale of user %d: %v", userID, err)
+		http.Error(w, "Error saving locale", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d set locale %s", userID, locale)
+	writeLocale(w, locale)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Notifications are rendered from templates kept on disk under
+// TEMPLATE_DIR, by default templates, with one directory per locale:
+//
+//	templates/en/layout.html
+//	templates/en/order_confirmation.txt
+//	templates/en/order_confirmation.html
+//	...
+//
+// Each message has a text template, which also defines its subject as
+// "subject", and an HTML template, which is rendered inside the locale's
+// layout.html as "content". Customers get their own locale if there are
+// templates for it, then its base language, then DEFAULT_LOCALE.
+var (
+	templateDir   = "templates"
+	defaultLocale = "en"
+
+	// templates holds the templates of each message by locale.
+	templates = make(map[string]map[string]*messageTemplate)
+)
+
+// The messages there are templates for.
+var messageNames = []string{
+	"order_confirmation",
+	"order_cancelled",
+	"payment_failed",
+	"refill_reminder",
+	"recall_notice",
+}
+
+type messageTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// Pharmacy is where orders are collected, shown in the order emails. It is
+// read from PHARMACY_NAME, PHARMACY_ADDRESS, PHARMACY_HOURS and
+// PHARMACY_PHONE.
+type Pharmacy struct {
+	Name    string
+	Address string
+	Hours   string
+	Phone   string
+}
+
+var pharmacy Pharmacy
+
+// TemplateData is what message templates are rendered with. Only the
+// fields a message is about are set.
+type TemplateData struct {
+	Pharmacy Pharmacy
+	Order    *OrderView
+	Recall   *RecallNotice
+	Reminder *RefillReminder
+
+	// Reason says why the order could not go ahead.
+	Reason string
+}
+
+// OrderView is an order with the names of its products.
+type OrderView struct {
+	Order
+	Lines []LineView
+}
+
+type LineView struct {
+	CartItem
+	Name string
+}
+
+var templateFuncs = map[string]any{
+	"money": formatCents,
+	"date":  func(t time.Time) string { return t.Format(time.DateOnly) },
+}
+
+func initTemplates() error {
+	if dir := os.Getenv("TEMPLATE_DIR"); dir != "" {
+		templateDir = dir
+	}
+	if locale := os.Getenv("DEFAULT_LOCALE"); locale != "" {
+		defaultLocale = strings.ToLower(locale)
+	}
+
+	pharmacy = Pharmacy{
+		Name:    os.Getenv("PHARMACY_NAME"),
+		Address: os.Getenv("PHARMACY_ADDRESS"),
+		Hours:   os.Getenv("PHARMACY_HOURS"),
+		Phone:   os.Getenv("PHARMACY_PHONE"),
+	}
+
+	entries, err := os.ReadDir(templateDir)
+	if err != nil {
+		return fmt.Errorf("error reading templates: %w", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		locale := strings.ToLower(entry.Name())
+		dir := filepath.Join(templateDir, entry.Name())
+		layout := filepath.Join(dir, "layout.html")
+
+		templates[locale] = make(map[string]*messageTemplate)
+		for _, name := range messageNames {
+			text, err := texttemplate.New(name + ".txt").Funcs(templateFuncs).ParseFiles(filepath.Join(dir, name+".txt"))
+			if err != nil {
+				return fmt.Errorf("error parsing %s template for %s: %w", name, locale, err)
+			}
+			if text.Lookup("subject") == nil {
+				return fmt.Errorf("%s template for %s has no subject", name, locale)
+			}
+
+			html, err := htmltemplate.New("layout.html").Funcs(templateFuncs).ParseFiles(layout, filepath.Join(dir, name+".html"))
+			if err != nil {
+				return fmt.Errorf("error parsing %s HTML template for %s: %w", name, locale, err)
+			}
+
+			templates[locale][name] = &messageTemplate{text: text, html: html}
+		}
+		log.Printf("Loaded notification templates for %s", locale)
+	}
+
+	if _, ok := templates[defaultLocale]; !ok {
+		return fmt.Errorf("no templates for the default locale %s", defaultLocale)
+	}
+	return nil
+}
+
+// locales returns the locales there are templates for.
+func locales() []string {
+	var list []string
+	for locale := range templates {
+		list = append(list, locale)
+	}
+	slices.Sort(list)
+	return list
+}
+
+// matchLocale returns the locale to write to a customer in: theirs if
+// there are templates for it, otherwise its base language, otherwise the
+// default.
+func matchLocale(locale string) string {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	if _, ok := templates[locale]; ok {
+		return locale
+	}
+	if base, _, ok := strings.Cut(locale, "-"); ok {
+		if _, ok := templates[base]; ok {
+			return base
+		}
+	}
+	return defaultLocale
+}
+
+// userLocale returns the locale the user chose, if any.
+func userLocale(userID int) string {
+	var locale string
+	err := db.QueryRow("SELECT COALESCE(locale, '') FROM users WHERE id = $1", userID).Scan(&locale)
+	if err != nil {
+		log.Printf("Error loading locale of user %d: %v", userID, err)
+		return ""
+	}
+	return locale
+}
+
+// compose renders the message in the user's locale into a notification.
+func compose(event, message string, userID int, email string, data TemplateData) (Notification, error) {
+	locale := matchLocale(userLocale(userID))
+	n, err := render(locale, message, data)
+	if err != nil {
+		return Notification{}, err
+	}
+
+	n.Event, n.UserID, n.Email = event, userID, email
+	return n, nil
+}
+
+// render renders the message in the locale, which must have templates.
+func render(locale, message string, data TemplateData) (Notification, error) {
+	tmpl := templates[locale][message]
+	data.Pharmacy = pharmacy
+
+	var subject, text, html bytes.Buffer
+	err := tmpl.text.ExecuteTemplate(&subject, "subject", data)
+	if err == nil {
+		err = tmpl.text.Execute(&text, data)
+	}
+	if err == nil {
+		err = tmpl.html.Execute(&html, data)
+	}
+	if err != nil {
+		return Notification{}, fmt.Errorf("error rendering %s for %s: %w", message, locale, err)
+	}
+
+	return Notification{
+		Locale:   locale,
+		Subject:  strings.TrimSpace(subject.String()),
+		Body:     strings.TrimSpace(text.String()) + "\n",
+		HTMLBody: html.String(),
+	}, nil
+}
+
+// orderView looks up the names of the order's products.
+func orderView(order Order) OrderView {
+	view := OrderView{Order: order}
+
+	var ids []int64
+	for _, item := range order.Cart {
+		ids = append(ids, int64(item.ProductID))
+	}
+
+	names := make(map[int]string)
+	rows, err := db.Query("SELECT id, name FROM products WHERE id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		log.Printf("Error loading product names of order %s: %v", order.OrderID, err)
+	} else {
+		for rows.Next() {
+			var id int
+			var name string
+			if err := rows.Scan(&id, &name); err == nil {
+				names[id] = name
+			}
+		}
+		rows.Close()
+	}
+
+	for _, item := range order.Cart {
+		name := names[item.ProductID]
+		if name == "" {
+			name = fmt.Sprintf("#%d", item.ProductID)
+		}
+		view.Lines = append(view.Lines, LineView{CartItem: item, Name: name})
+	}
+	return view
+}
+
+// formatCents formats an amount in cents as dollars, e.g. -$1.50.
+func formatCents(cents int64) string {
+	sign, amount := "", uint64(cents)
+	if cents < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s$%d.%02d", sign, amount/100, amount%100)
+}
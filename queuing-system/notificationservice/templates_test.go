@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatCents(t *testing.T) {
+	tests := []struct {
+		cents int64
+		want  string
+	}{
+		{0, "$0.00"},
+		{5, "$0.05"},
+		{150, "$1.50"},
+		{123456, "$1234.56"},
+		{-5, "-$0.05"},
+		{-150, "-$1.50"},
+		{-100, "-$1.00"},
+		{-9223372036854775808, "-$92233720368547758.08"},
+	}
+
+	for _, tt := range tests {
+		if got := formatCents(tt.cents); got != tt.want {
+			t.Errorf("formatCents(%d) = %q, want %q", tt.cents, got, tt.want)
+		}
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	t.Setenv("TEMPLATE_DIR", "templates")
+	t.Setenv("DEFAULT_LOCALE", "en")
+	t.Setenv("PHARMACY_NAME", "Main Street Pharmacy")
+	if err := initTemplates(); err != nil {
+		t.Fatalf("initTemplates: %v", err)
+	}
+
+	order := &OrderView{
+		Order: Order{
+			OrderID:       "ord-1",
+			SubtotalCents: 1000,
+			TaxCents:      80,
+			TotalCents:    1080,
+			Interactions:  []Interaction{{DrugA: "Warfarin", DrugB: "Aspirin", Severity: "major"}},
+		},
+		Lines: []LineView{{CartItem: CartItem{ProductID: 1, Quantity: 2, UnitPriceCents: 500, LineTotalCents: 1000}, Name: "Ibuprofen <200mg>"}},
+	}
+	tests := []struct {
+		message string
+		data    TemplateData
+		want    []string
+	}{
+		{"order_confirmation", TemplateData{Order: order}, []string{"ord-1", "$10.80", "Warfarin", "Main Street Pharmacy"}},
+		{"order_cancelled", TemplateData{Order: order}, []string{"ord-1"}},
+		{"payment_failed", TemplateData{Order: order, Reason: "Card declined"}, []string{"ord-1", "Card declined", "$10.80"}},
+		{"refill_reminder", TemplateData{Reminder: &RefillReminder{
+			PrescriptionID: 7, ProductName: "Amoxicillin", FillsRemaining: 2, ExpiresAt: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC),
+		}}, []string{"Amoxicillin", "2026-03-01"}},
+		{"recall_notice", TemplateData{Recall: &RecallNotice{
+			OrderID: "ord-1", ProductName: "Cough Syrup", BatchNumbers: []string{"B1", "B2"}, Quantity: 3, Reason: "Contamination",
+		}}, []string{"Cough Syrup", "ord-1", "B1, B2", "Contamination"}},
+	}
+
+	for _, locale := range locales() {
+		for _, tt := range tests {
+			n, err := render(locale, tt.message, tt.data)
+			if err != nil {
+				t.Errorf("render(%s, %s): %v", locale, tt.message, err)
+				continue
+			}
+			if n.Subject == "" || strings.Contains(n.Subject, "\n") {
+				t.Errorf("render(%s, %s): subject %q is not one line", locale, tt.message, n.Subject)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(n.Body, want) {
+					t.Errorf("render(%s, %s): text body does not contain %q:\n%s", locale, tt.message, want, n.Body)
+				}
+			}
+			if strings.Contains(n.HTMLBody, "<200mg>") {
+				t.Errorf("render(%s, %s): HTML body does not escape product names", locale, tt.message)
+			}
+		}
+	}
+}
+
+func TestMatchLocale(t *testing.T) {
+	templates = map[string]map[string]*messageTemplate{"en": nil, "es": nil, "pt-br": nil}
+	defaultLocale = "en"
+	t.Cleanup(func() { templates = make(map[string]map[string]*messageTemplate) })
+
+	tests := []struct {
+		locale string
+		want   string
+	}{
+		{"es", "es"},
+		{"es-MX", "es"},
+		{"es_mx", "es"},
+		{"pt-BR", "pt-br"},
+		{"pt", "en"},
+		{"fr", "en"},
+		{"", "en"},
+	}
+
+	for _, tt := range tests {
+		if got := matchLocale(tt.locale); got != tt.want {
+			t.Errorf("matchLocale(%q) = %q, want %q", tt.locale, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+module orchestrator
+
+go 1.22.3
+
+require (
+	github.com/gorilla/handlers v1.5.2
+	github.com/joho/godotenv v1.5.1
+	github.com/lib/pq v1.10.9
+	shared v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/felixge/httpsnoop v1.0.3 // indirect
+	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
+	github.com/streadway/amqp v1.1.0 // indirect
+)
+
+replace shared => ../shared
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"shared/auth"
+)
+
+// Interaction severities. A severe interaction holds the order until a
+// pharmacist has reviewed it; the others are only listed in the
+// confirmation email.
+const (
+	severityMinor    = "minor"
+	severityModerate = "moderate"
+	severitySevere   = "severe"
+)
+
+// Interaction is a known interaction between two drugs, identified by
+// their generic names.
+type Interaction struct {
+	DrugA       string `json:"drug_a"`
+	DrugB       string `json:"drug_b"`
+	Severity    string `json:"severity"`
+	Description string `json:"description"`
+}
+
+// interaction_reviews records the pharmacist's decision on orders held for
+// a severe interaction.
+const interactionSchema = `
+CREATE TABLE IF NOT EXISTS interaction_reviews (
+	order_id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	interactions JSONB NOT NULL,
+	status TEXT NOT NULL DEFAULT 'PENDING',
+	reviewed_by INTEGER,
+	review_note TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	reviewed_at TIMESTAMP
+);`
+
+const (
+	reviewPending  = "PENDING"
+	reviewApproved = "APPROVED"
+	reviewRejected = "REJECTED"
+)
+
+var (
+	// interactions maps a pair of drugs, in alphabetical order, to their
+	// interaction.
+	interactions = make(map[[2]string]Interaction)
+
+	// interactionHistory is how far back the customer's earlier orders
+	// are checked against the order.
+	interactionHistory = 90 * 24 * time.Hour
+)
+
+type InteractionReview struct {
+	OrderID      string        `json:"order_id"`
+	UserID       int           `json:"user_id"`
+	Interactions []Interaction `json:"interactions"`
+	Status       string        `json:"status"`
+	ReviewedBy   *int          `json:"reviewed_by,omitempty"`
+	ReviewNote   string        `json:"review_note,omitempty"`
+	CreatedAt    time.Time     `json:"created_at"`
+	ReviewedAt   *time.Time    `json:"reviewed_at,omitempty"`
+}
+
+// initInteractions loads the interaction dataset named by
+// INTERACTIONS_FILE, a CSV or JSON file, and creates the review table.
+func initInteractions() error {
+	path := os.Getenv("INTERACTIONS_FILE")
+	if path == "" {
+		path = "interactions.csv"
+	}
+
+	if days := os.Getenv("INTERACTION_HISTORY_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid INTERACTION_HISTORY_DAYS %q", days)
+		}
+		interactionHistory = time.Duration(n) * 24 * time.Hour
+	}
+
+	list, err := loadInteractions(path)
+	if err != nil {
+		return fmt.Errorf("error loading interactions from %s: %w", path, err)
+	}
+	for _, interaction := range list {
+		interactions[drugPair(interaction.DrugA, interaction.DrugB)] = interaction
+	}
+	log.Printf("Loaded %d drug interactions from %s", len(interactions), path)
+
+	_, err = db.Exec(interactionSchema)
+	if err != nil {
+		return fmt.Errorf("error creating interaction review table: %w", err)
+	}
+	return nil
+}
+
+// loadInteractions reads a JSON array of interactions, or a CSV file with
+// the columns drug_a, drug_b, severity and description and a header row.
+func loadInteractions(path string) ([]Interaction, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []Interaction
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.NewDecoder(f).Decode(&list)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		reader := csv.NewReader(f)
+		reader.FieldsPerRecord = 4
+		reader.TrimLeadingSpace = true
+		if _, err := reader.Read(); err != nil {
+			return nil, err
+		}
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, Interaction{
+				DrugA:       record[0],
+				DrugB:       record[1],
+				Severity:    record[2],
+				Description: record[3],
+			})
+		}
+	}
+
+	for i := range list {
+		interaction := &list[i]
+		interaction.DrugA = strings.ToLower(strings.TrimSpace(interaction.DrugA))
+		interaction.DrugB = strings.ToLower(strings.TrimSpace(interaction.DrugB))
+		interaction.Severity = strings.ToLower(strings.TrimSpace(interaction.Severity))
+		switch interaction.Severity {
+		case severityMinor, severityModerate, severitySevere:
+		default:
+			return nil, fmt.Errorf("unknown severity %q for %s and %s",
+				interaction.Severity, interaction.DrugA, interaction.DrugB)
+		}
+	}
+	return list, nil
+}
+
+func drugPair(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// drugNamesQuery wraps a query for the id, name and generic_name of
+// products. It returns every lower-cased name each product goes by: its
+// own names, their canonical names in drug_synonyms and every other term
+// with the same canonical name. The interaction dataset may use any of
+// them, e.g. aspirin for a product sold as Bayer.
+const drugNamesQuery = `
+WITH drugs AS (%s), names AS (
+	SELECT id, LOWER(TRIM(name)) AS name FROM drugs
+	UNION
+	SELECT id, LOWER(TRIM(generic_name)) FROM drugs
+), canonical AS (
+	SELECT n.id, s.canonical FROM names n JOIN drug_synonyms s ON s.term = n.name
+	UNION
+	SELECT id, name FROM names
+)
+SELECT id, name FROM names WHERE name <> ''
+UNION
+SELECT id, canonical FROM canonical WHERE canonical <> ''
+UNION
+SELECT c.id, s.term FROM canonical c JOIN drug_synonyms s ON s.canonical = c.canonical`
+
+// drugNames returns the names of the products returned by query, as
+// drugNamesQuery finds them.
+func drugNames(query string, args ...any) (map[int][]string, error) {
+	rows, err := db.Query(fmt.Sprintf(drugNamesQuery, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[int][]string)
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = append(names[id], name)
+	}
+	return names, rows.Err()
+}
+
+// findInteractions returns the interactions between the products of the
+// order, and between them and the products the customer ordered in the
+// last interactionHistory.
+func findInteractions(order *Order) ([]Interaction, error) {
+	var productIDs []int64
+	for _, item := range order.Cart {
+		productIDs = append(productIDs, int64(item.ProductID))
+	}
+
+	cart, err := drugNames("SELECT id, name, generic_name FROM products WHERE id = ANY($1)", pq.Array(productIDs))
+	if err != nil {
+		return nil, fmt.Errorf("error loading products of order: %w", err)
+	}
+
+	history, err := drugNames(`SELECT DISTINCT p.id, p.name, p.generic_name FROM orders o JOIN products p ON p.id = o.product_id
+		WHERE o.user_id = $1 AND o.order_date >= $2 AND o.order_id IS DISTINCT FROM $3`,
+		order.UserID, time.Now().Add(-interactionHistory), order.OrderID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading order history of user %d: %w", order.UserID, err)
+	}
+
+	found := []Interaction{}
+	seen := make(map[[2]string]bool)
+	check := func(a, b []string) {
+		for _, x := range a {
+			for _, y := range b {
+				pair := drugPair(x, y)
+				if interaction, ok := interactions[pair]; ok && !seen[pair] {
+					seen[pair] = true
+					found = append(found, interaction)
+				}
+			}
+		}
+	}
+	for id, names := range cart {
+		for otherID, other := range cart {
+			if id < otherID {
+				check(names, other)
+			}
+		}
+		for _, other := range history {
+			check(names, other)
+		}
+	}
+	return found, nil
+}
+
+// checkInteractions reports whether the order may be placed, and records
+// its interactions on the order for screenInteractions. An order with a
+// severe interaction is held for review: it returns false until a
+// pharmacist has approved the order, and an error once they have rejected
+// it.
+func checkInteractions(order *Order) (bool, error) {
+	found, err := findInteractions(order)
+	if err != nil {
+		return false, err
+	}
+	order.Interactions = found
+
+	severe := false
+	for _, interaction := range found {
+		severe = severe || interaction.Severity == severitySevere
+	}
+	if !severe {
+		return true, nil
+	}
+
+	jsonInteractions, err := json.Marshal(found)
+	if err != nil {
+		return false, fmt.Errorf("error marshaling interactions: %w", err)
+	}
+
+	var status, note string
+	err = db.QueryRow(`INSERT INTO interaction_reviews (order_id, user_id, interactions) VALUES ($1, $2, $3)
+		ON CONFLICT (order_id) DO UPDATE SET order_id = EXCLUDED.order_id
+		RETURNING status, review_note`, order.OrderID, order.UserID, jsonInteractions).Scan(&status, &note)
+	if err != nil {
+		return false, fmt.Errorf("error recording interaction review: %w", err)
+	}
+
+	switch status {
+	case reviewApproved:
+		return true, nil
+	case reviewRejected:
+		order.FailureReason = "Order rejected by the pharmacist because of a drug interaction"
+		if note != "" {
+			order.FailureReason += ": " + note
+		}
+		return false, fmt.Errorf("order %s was rejected after interaction review", order.OrderID)
+	default:
+		return false, nil
+	}
+}
+
+// screenInteractions keeps the interactions checkInteractions found on the
+// order, which runSaga saves once the step succeeded, so that the
+// confirmation email lists them. checkInteractions always runs first, also
+// when a saga is resumed.
+func screenInteractions(order *Order) bool {
+	if order.Interactions == nil {
+		log.Printf("Interactions of order %s were not checked", order.OrderID)
+		return false
+	}
+	return true
+}
+
+// noCompensation is the compensation of steps with no effect to undo.
+func noCompensation(Order) bool {
+	return true
+}
+
+func listInteractionReviews(w http.ResponseWriter, r *http.Request) {
+	log.Print("listInteractionReviews invoked")
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = reviewPending
+	}
+
+	rows, err := db.Query(`SELECT order_id, user_id, interactions, status, reviewed_by, review_note, created_at, reviewed_at
+		FROM interaction_reviews WHERE status = $1 ORDER BY created_at`, strings.ToUpper(status))
+	if err != nil {
+		log.Printf("Error loading interaction reviews: %v", err)
+		writeError(w, "Error fetching reviews", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	reviews := []InteractionReview{}
+	for rows.Next() {
+		var review InteractionReview
+		var jsonInteractions []byte
+		var reviewedBy sql.NullInt64
+		var reviewedAt sql.NullTime
+		err := rows.Scan(&review.OrderID, &review.UserID, &jsonInteractions, &review.Status, &reviewedBy,
+			&review.ReviewNote, &review.CreatedAt, &reviewedAt)
+		if err == nil {
+			err = json.Unmarshal(jsonInteractions, &review.Interactions)
+		}
+		if err != nil {
+			log.Printf("Error scanning interaction review: %v", err)
+			writeError(w, "Error fetching reviews", http.StatusInternalServerError)
+			return
+		}
+		if reviewedBy.Valid {
+			id := int(reviewedBy.Int64)
+			review.ReviewedBy = &id
+		}
+		if reviewedAt.Valid {
+			review.ReviewedAt = &reviewedAt.Time
+		}
+		reviews = append(reviews, review)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// reviewInteractions records the pharmacist's decision on an order held
+// for a severe interaction and resumes its saga.
+func reviewInteractions(w http.ResponseWriter, r *http.Request) {
+	log.Print("reviewInteractions invoked")
+
+	orderID := r.PathValue("id")
+
+	var decision struct {
+		Approve bool   `json:"approve"`
+		Note    string `json:"note"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&decision)
+	if err != nil {
+		writeError(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	status := reviewRejected
+	if decision.Approve {
+		status = reviewApproved
+	}
+
+	res, err := db.Exec(`UPDATE interaction_reviews SET status = $1, review_note = $2, reviewed_by = $3, reviewed_at = NOW()
+		WHERE order_id = $4 AND status = $5`, status, decision.Note, auth.CurrentUser(r).ID, orderID, reviewPending)
+	if err != nil {
+		log.Printf("Error reviewing order %s: %v", orderID, err)
+		writeError(w, "Failed to record review", http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		writeError(w, "No pending review for this order", http.StatusNotFound)
+		return
+	}
+
+	var sagaID int
+	err = db.QueryRow("SELECT id FROM sagas WHERE order_id = $1", orderID).Scan(&sagaID)
+	if err != nil {
+		log.Printf("Error finding saga of order %s: %v", orderID, err)
+	} else {
+		go func() {
+			if err := resumeSaga(sagaID); err != nil {
+				log.Printf("Error resuming saga %d: %v", sagaID, err)
+			}
+		}()
+	}
+
+	log.Printf("Interactions of order %s %s by user %d", orderID, strings.ToLower(status), auth.CurrentUser(r).ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":  "Review recorded",
+		"order_id": orderID,
+		"status":   status,
+	})
+}
@@ -2,27 +2,57 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"sync"
+	"os"
+	"strings"
 
 	"github.com/joho/godotenv"
 	"github.com/gorilla/handlers"
+
+	_ "github.com/lib/pq"
+
+	"shared/auth"
+	"shared/idempotency"
+	"shared/synonyms"
 )
 
-var mu sync.Mutex
+var db *sql.DB
 
+// Amounts are in cents. Prices and totals are set by the place order
+// service; whatever the client sends for them is ignored.
 type CartItem struct {
-	ProductID int `json:"product_id"`
-	Quantity  int `json:"quantity"`
+	ProductID      int   `json:"product_id"`
+	Quantity       int   `json:"quantity"`
+	UnitPriceCents int64 `json:"unit_price_cents"`
+	LineTotalCents int64 `json:"line_total_cents"`
 }
 
 type Order struct {
-	UserID  int       `json:"user_id"`
-	EmailID string    `json:"email_id"`
-	Cart    []CartItem `json:"cart"`
+	OrderID       string    `json:"order_id"`
+	UserID        int       `json:"user_id"`
+	EmailID       string    `json:"email_id"`
+	Cart          []CartItem `json:"cart"`
+	SubtotalCents int64     `json:"subtotal_cents"`
+	TaxCents      int64     `json:"tax_cents"`
+	TotalCents    int64     `json:"total_cents"`
+
+	// Interactions are the non-blocking drug interactions found in the
+	// order, listed in the confirmation email.
+	Interactions []Interaction `json:"interactions,omitempty"`
+
+	// IdempotencyKey is sent with every downstream call of the saga so
+	// that repeating a call never repeats its effect.
+	IdempotencyKey string `json:"-"`
+
+	// FailureReason, if set by a failed step, is shown to the customer
+	// instead of the step's generic failure message.
+	FailureReason string `json:"-"`
 }
 
 func main() {
@@ -31,18 +61,94 @@ func main() {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
 
-	http.HandleFunc("/confirmorder", confirmOrder)
+	err = InitDB()
+	if err != nil {
+		log.Fatalf("Error initializing database: %v", err)
+	}
+
+	err = auth.Init(db)
+	if err != nil {
+		log.Fatalf("Error initializing auth: %v", err)
+	}
+	// Rejected requests are answered in the same JSON as every other
+	// error here.
+	auth.WriteError = writeError
+
+	err = initSagaLog()
+	if err != nil {
+		log.Fatalf("Error initializing saga log: %v", err)
+	}
+
+	err = idempotency.Init(db, "orchestrator")
+	if err != nil {
+		log.Fatalf("Error initializing idempotency store: %v", err)
+	}
+
+	err = synonyms.Init(db)
+	if err != nil {
+		log.Fatalf("Error initializing drug synonyms: %v", err)
+	}
+
+	err = initInteractions()
+	if err != nil {
+		log.Fatalf("Error initializing interaction checks: %v", err)
+	}
+
+	err = initBroker()
+	if err != nil {
+		log.Fatalf("Error initializing message broker: %v", err)
+	}
+	defer broker.Close()
+
+	recoverSagas()
+
+	err = consumeConfirmations()
+	if err != nil {
+		log.Fatalf("Error consuming order confirmations: %v", err)
+	}
+	go resumeWaitingSagas()
+
+	http.HandleFunc("/confirmorder", auth.RequireAuth(idempotency.Wrap(confirmOrder)))
+	http.HandleFunc("GET /orders/{id}", auth.RequireAuth(getOrder))
+	http.HandleFunc("GET /orders", auth.RequireAuth(listOrders))
+	http.HandleFunc("POST /orders/{id}/refund", auth.RequireRole(refundOrder, auth.RolePharmacist, auth.RoleAdmin))
+	http.HandleFunc("GET /reviews", auth.RequireRole(listInteractionReviews, auth.RolePharmacist, auth.RoleAdmin))
+	http.HandleFunc("POST /orders/{id}/review", auth.RequireRole(reviewInteractions, auth.RolePharmacist, auth.RoleAdmin))
 
 	corsHandler := handlers.CORS(
 		handlers.AllowedOrigins([]string{"http://localhost:9003"}),
 		handlers.AllowedMethods([]string{"GET", "POST", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "Idempotency-Key"}),
+		handlers.AllowCredentials(),
 	)(http.DefaultServeMux)
 
 	fmt.Println("Starting orchestrator service at port 8005")
 	log.Fatal(http.ListenAndServe(":8005", corsHandler))
 }
 
+func InitDB() error {
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("DB_HOST"),
+		os.Getenv("DB_PORT"),
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_PASSWORD"),
+		os.Getenv("DB_NAME"))
+
+	var err error
+	db, err = sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("error connecting to the database: %w", err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return fmt.Errorf("error pinging the database: %w", err)
+	}
+
+	log.Println("Successfully connected to the database")
+	return nil
+}
+
 func confirmOrder(w http.ResponseWriter, r *http.Request) {
 	log.Print("confirmOrder invoked")
 
@@ -62,40 +168,73 @@ func confirmOrder(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "No items provided", http.StatusBadRequest)
 		return
 	}
+	for _, item := range order.Cart {
+		if item.Quantity < 1 {
+			http.Error(w, fmt.Sprintf("Invalid quantity for product ID %d", item.ProductID), http.StatusBadRequest)
+			return
+		}
+	}
 
-	// Place the order
-	success := callPlaceOrderService(order)
-	if !success {
-		writeError(w, "Failed to place order", http.StatusInternalServerError)
+	// The order belongs to whoever the token says placed it.
+	user := auth.CurrentUser(r)
+	if order.UserID != 0 && order.UserID != user.ID {
+		writeError(w, "Order user does not match the authenticated user", http.StatusForbidden)
 		return
 	}
+	order.UserID = user.ID
+	if user.Email != "" {
+		order.EmailID = user.Email
+	}
+
+	for i := range order.Cart {
+		order.Cart[i].UnitPriceCents = 0
+		order.Cart[i].LineTotalCents = 0
+	}
+	order.SubtotalCents, order.TaxCents, order.TotalCents = 0, 0, 0
+
+	// Without a client key the saga still gets one of its own, so that
+	// steps re-run after a restart are not applied twice downstream.
+	requestKey := r.Header.Get("Idempotency-Key")
+	if requestKey == "" {
+		requestKey, err = randomID()
+		if err != nil {
+			log.Printf("Failed to generate idempotency key: %v", err)
+			writeError(w, "Failed to record order", http.StatusInternalServerError)
+			return
+		}
+	}
 
-	// Process payment
-	success = callPaymentService(order)
-	if !success {
-		rollbackPlaceOrderService(order)
-		writeError(w, "Failed to process payment", http.StatusInternalServerError)
+	order.OrderID, err = randomID()
+	if err != nil {
+		log.Printf("Failed to generate order ID: %v", err)
+		writeError(w, "Failed to record order", http.StatusInternalServerError)
 		return
 	}
 
-	// Send notification
-	success = callNotificationService(order)
-	if !success {
-		rollbackPlaceOrderService(order)
-		writeError(w, "Failed to send notification", http.StatusInternalServerError)
+	sagaID, err := startSaga(&order, requestKey)
+	if err != nil {
+		log.Printf("Failed to record saga: %v", err)
+		writeError(w, "Failed to record order", http.StatusInternalServerError)
 		return
 	}
 
-	// Remove from database
-	success = callRemoveDBService(order)
-	if !success {
-		rollbackPlaceOrderService(order)
-		writeError(w, "Failed to remove from DB", http.StatusInternalServerError)
+	err = enqueueSaga(sagaID)
+	if err != nil {
+		// Nothing has run yet; close the saga so recovery does not start
+		// an order the client was told failed.
+		log.Printf("Failed to enqueue saga %d: %v", sagaID, err)
+		setFailureReason(sagaID, "Failed to queue order")
+		compensateSaga(sagaID, order, 0)
+		writeError(w, "Failed to queue order", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "Order confirmed successfully"})
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":  "Order accepted",
+		"order_id": order.OrderID,
+	})
 }
 
 func writeError(w http.ResponseWriter, message string, statusCode int) {
@@ -104,52 +243,260 @@ func writeError(w http.ResponseWriter, message string, statusCode int) {
 	json.NewEncoder(w).Encode(map[string]string{"message": message})
 }
 
-func callPlaceOrderService(order Order) bool {
-	url := "http://localhost:9003/placeorder" // Place order service URL
+// randomID returns a random hex string for use as an order ID, idempotency
+// key or message correlation ID.
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
 
+// callPlaceOrderService places the order and records the order ID, prices
+// and totals the place order service confirmed for it.
+func callPlaceOrderService(order *Order) bool {
 	jsonOrder, err := json.Marshal(order)
 	if err != nil {
 		log.Printf("Error marshaling order: %v", err)
 		return false
 	}
 
-	resp, err := makeRequest("POST", url, jsonOrder)
+	resp, err := requestService("placeorder", "/placeorder", jsonOrder, order.IdempotencyKey, order.UserID)
+	if err == nil && (resp.StatusCode == http.StatusUnprocessableEntity || resp.StatusCode == http.StatusNotFound) {
+		// The order breaks a purchase rule, e.g. a quantity limit, or
+		// holds a product that cannot be bought. Rule violations come as
+		// JSON, the rest as plain text.
+		var refusal struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(resp.Body, &refusal) != nil {
+			refusal.Message = strings.TrimSpace(string(resp.Body))
+		}
+		log.Printf("Place order service refused order of user %d: %s", order.UserID, refusal.Message)
+		order.FailureReason = refusal.Message
+		return false
+	}
 	if err != nil || resp.StatusCode != http.StatusOK {
 		log.Printf("Error calling place order service: %v", err)
 		return false
 	}
 
+	var placed Order
+	err = json.Unmarshal(resp.Body, &placed)
+	if err != nil || placed.OrderID == "" {
+		log.Printf("Error reading placed order from place order service: %v", err)
+		return false
+	}
+
+	order.OrderID = placed.OrderID
+	order.Cart = placed.Cart
+	order.SubtotalCents = placed.SubtotalCents
+	order.TaxCents = placed.TaxCents
+	order.TotalCents = placed.TotalCents
+	log.Printf("Order %s placed for user %d, total %d", order.OrderID, order.UserID, order.TotalCents)
+	return true
+}
+
+// callInventoryService allocates the order's stock. It is the only stock
+// check of the order.
+func callInventoryService(order *Order) bool {
+	jsonOrder, err := json.Marshal(order)
+	if err != nil {
+		log.Printf("Error marshaling order for inventory: %v", err)
+		return false
+	}
+
+	resp, err := requestService("removedb", "/inventory/allocate", jsonOrder, order.IdempotencyKey, order.UserID)
+	if err == nil && resp.StatusCode == http.StatusConflict {
+		order.FailureReason = strings.TrimSpace(string(resp.Body))
+		log.Printf("Not enough stock for order %s: %s", order.OrderID, order.FailureReason)
+		return false
+	}
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("Error allocating stock: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// releaseInventoryService gives back the order's allocated stock.
+func releaseInventoryService(order Order) bool {
+	jsonOrder, err := json.Marshal(order)
+	if err != nil {
+		log.Printf("Error marshaling order for inventory release: %v", err)
+		return false
+	}
+
+	resp, err := requestService("removedb", "/inventory/release", jsonOrder, order.IdempotencyKey, order.UserID)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("Error releasing stock: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// checkPrescriptionService reports whether every prescription-only product
+// in the order is covered by an approved prescription. It returns false
+// while prescriptions await review and an error if any product has none.
+func checkPrescriptionService(order *Order) (bool, error) {
+	jsonOrder, err := json.Marshal(order)
+	if err != nil {
+		return false, fmt.Errorf("error marshaling order for prescription check: %w", err)
+	}
+
+	resp, err := requestService("prescription", "/prescriptions/check", jsonOrder, "", order.UserID)
+	if err != nil {
+		return false, fmt.Errorf("error calling prescription service: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusAccepted:
+		return false, nil
+	default:
+		return false, fmt.Errorf("prescription check failed with status %d: %s", resp.StatusCode, resp.Body)
+	}
+}
+
+func callPrescriptionService(order *Order) bool {
+	jsonOrder, err := json.Marshal(order)
+	if err != nil {
+		log.Printf("Error marshaling order for prescriptions: %v", err)
+		return false
+	}
+
+	resp, err := requestService("prescription", "/prescriptions/fill", jsonOrder, order.IdempotencyKey, order.UserID)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("Error calling prescription service: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// callAuthorizeService places a hold for the order's total. A payment that
+// needs the customer to answer a challenge first counts as authorized here;
+// the payment step waits for the answer.
+func callAuthorizeService(order *Order) bool {
+	jsonOrder, err := json.Marshal(order)
+	if err != nil {
+		log.Printf("Error marshaling order for payment: %v", err)
+		return false
+	}
+
+	resp, err := requestService("payment", "/payment/authorize", jsonOrder, order.IdempotencyKey, order.UserID)
+	if err != nil || (resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted) {
+		log.Printf("Error authorizing payment: %v", err)
+		notifyPaymentFailed(*order, paymentFailureReason(resp))
+		return false
+	}
+
 	return true
 }
 
-func callPaymentService(order Order) bool {
-	url := "http://localhost:8006/payment" // Payment service URL
+// checkPaymentService reports whether the order's payment is authorized,
+// or still waiting for the customer to answer a challenge. A declined
+// challenge fails the step.
+func checkPaymentService(order *Order) (bool, error) {
+	jsonOrder, err := json.Marshal(order)
+	if err != nil {
+		return false, fmt.Errorf("error marshaling order for payment check: %w", err)
+	}
+
+	resp, err := requestService("payment", "/payment/status", jsonOrder, "", order.UserID)
+	if err != nil {
+		return false, fmt.Errorf("error calling payment service: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("payment check failed with status %d: %s", resp.StatusCode, resp.Body)
+	}
+
+	var body struct {
+		Payment struct {
+			Status string `json:"status"`
+		} `json:"payment"`
+	}
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		return false, fmt.Errorf("error decoding payment check: %w", err)
+	}
 
+	switch body.Payment.Status {
+	case "AUTHORIZED", "CAPTURED":
+		return true, nil
+	case "CHALLENGE_REQUIRED":
+		return false, nil
+	default:
+		order.FailureReason = "Payment declined"
+		notifyPaymentFailed(*order, order.FailureReason)
+		return false, fmt.Errorf("payment is %s", body.Payment.Status)
+	}
+}
+
+// callPaymentService captures the authorized payment. If that fails, the
+// authorize step's compensation releases the hold.
+func callPaymentService(order *Order) bool {
 	jsonOrder, err := json.Marshal(order)
 	if err != nil {
 		log.Printf("Error marshaling order for payment: %v", err)
 		return false
 	}
 
-	resp, err := makeRequest("POST", url, jsonOrder)
+	resp, err := requestService("payment", "/payment/capture", jsonOrder, order.IdempotencyKey, order.UserID)
 	if err != nil || resp.StatusCode != http.StatusOK {
-		log.Printf("Error calling payment service: %v", err)
+		log.Printf("Error capturing payment: %v", err)
+		notifyPaymentFailed(*order, paymentFailureReason(resp))
 		return false
 	}
 
 	return true
 }
 
-func callNotificationService(order Order) bool {
-	url := "http://localhost:8004/notify" // Notification service URL
+// paymentFailureReason returns the message the payment service failed
+// with, if it answered at all.
+func paymentFailureReason(resp *serviceResponse) string {
+	if resp == nil {
+		return ""
+	}
+
+	var body struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(resp.Body, &body) != nil {
+		return ""
+	}
+	return body.Message
+}
+
+// notifyPaymentFailed tells the customer that their order could not be
+// paid for. It is best effort: the saga fails either way.
+func notifyPaymentFailed(order Order, reason string) {
+	jsonFailure, err := json.Marshal(struct {
+		Order
+		Reason string `json:"reason,omitempty"`
+	}{order, reason})
+	if err != nil {
+		log.Printf("Error marshaling payment failure for notification: %v", err)
+		return
+	}
 
+	resp, err := requestService("notification", "/payment-failed", jsonFailure, order.IdempotencyKey, order.UserID)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("Error notifying payment failure of order %s: %v", order.OrderID, err)
+	}
+}
+
+func callNotificationService(order *Order) bool {
 	jsonOrder, err := json.Marshal(order)
 	if err != nil {
 		log.Printf("Error marshaling order for notification: %v", err)
 		return false
 	}
 
-	resp, err := makeRequest("POST", url, jsonOrder)
+	resp, err := requestService("notification", "/notify", jsonOrder, order.IdempotencyKey, order.UserID)
 	if err != nil || resp.StatusCode != http.StatusOK {
 		log.Printf("Error calling notification service: %v", err)
 		return false
@@ -158,16 +505,14 @@ func callNotificationService(order Order) bool {
 	return true
 }
 
-func callRemoveDBService(order Order) bool {
-	url := "http://localhost:8007/remove" // Remove from DB service URL
-
+func callRemoveDBService(order *Order) bool {
 	jsonOrder, err := json.Marshal(order)
 	if err != nil {
 		log.Printf("Error marshaling order for remove DB: %v", err)
 		return false
 	}
 
-	resp, err := makeRequest("POST", url, jsonOrder)
+	resp, err := requestService("removedb", "/inventory/commit", jsonOrder, order.IdempotencyKey, order.UserID)
 	if err != nil || resp.StatusCode != http.StatusOK {
 		log.Printf("Error calling remove DB service: %v", err)
 		return false
@@ -176,22 +521,103 @@ func callRemoveDBService(order Order) bool {
 	return true
 }
 
-func rollbackPlaceOrderService(order Order) {
-	url := "http://localhost:9003/rollback" // Place order rollback URL
-
+func rollbackPlaceOrderService(order Order) bool {
 	jsonOrder, err := json.Marshal(order)
 	if err != nil {
 		log.Printf("Error marshaling order for rollback: %v", err)
-		return
+		return false
 	}
 
-	resp, err := makeRequest("POST", url, jsonOrder)
+	resp, err := requestService("placeorder", "/rollback", jsonOrder, order.IdempotencyKey, order.UserID)
 	if err != nil || resp.StatusCode != http.StatusOK {
 		log.Printf("Error calling place order rollback service: %v", err)
+		return false
 	}
+
+	return true
 }
 
-func makeRequest(method, url string, jsonBody []byte) (*http.Response, error) {
+func refundPaymentService(order Order) bool {
+	jsonOrder, err := json.Marshal(order)
+	if err != nil {
+		log.Printf("Error marshaling order for refund: %v", err)
+		return false
+	}
+
+	resp, err := requestService("payment", "/payment/refund", jsonOrder, order.IdempotencyKey, order.UserID)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("Error calling payment refund service: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func voidPaymentService(order Order) bool {
+	jsonOrder, err := json.Marshal(order)
+	if err != nil {
+		log.Printf("Error marshaling order for void: %v", err)
+		return false
+	}
+
+	resp, err := requestService("payment", "/payment/void", jsonOrder, order.IdempotencyKey, order.UserID)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("Error calling payment void service: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func cancelNotificationService(order Order) bool {
+	jsonOrder, err := json.Marshal(order)
+	if err != nil {
+		log.Printf("Error marshaling order for cancellation notice: %v", err)
+		return false
+	}
+
+	resp, err := requestService("notification", "/cancel", jsonOrder, order.IdempotencyKey, order.UserID)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("Error calling notification cancel service: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func releasePrescriptionService(order Order) bool {
+	jsonOrder, err := json.Marshal(order)
+	if err != nil {
+		log.Printf("Error marshaling order for prescription release: %v", err)
+		return false
+	}
+
+	resp, err := requestService("prescription", "/prescriptions/release", jsonOrder, order.IdempotencyKey, order.UserID)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("Error calling prescription release service: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func rollbackRemoveDBService(order Order) bool {
+	jsonOrder, err := json.Marshal(order)
+	if err != nil {
+		log.Printf("Error marshaling order for remove DB rollback: %v", err)
+		return false
+	}
+
+	resp, err := requestService("removedb", "/inventory/release", jsonOrder, order.IdempotencyKey, order.UserID)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("Error calling remove DB rollback service: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func makeRequest(method, url string, jsonBody []byte, idempotencyKey, authorization string) (*http.Response, error) {
 	req, err := http.NewRequest(method, url, bytes.NewBuffer(jsonBody))
 	if err != nil {
 		log.Printf("Error creating request: %v", err)
@@ -199,6 +625,12 @@ func makeRequest(method, url string, jsonBody []byte) (*http.Response, error) {
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+
+	"shared/auth"
+)
+
+// Order states as seen by the customer. Every successful saga step moves
+// the order one state forward; a failed step moves it to COMPENSATING and,
+// once every completed step has been undone, to FAILED. An order with a
+// severe drug interaction waits in AWAITING_REVIEW until a pharmacist has
+// reviewed it, and one with prescription-only products waits in
+// AWAITING_PRESCRIPTION until a pharmacist has approved the prescriptions.
+// One whose payment needs the customer to answer a challenge waits in
+// AWAITING_PAYMENT until they have.
+// Staff may refund a completed order, which moves it to REFUNDED.
+const (
+	statePending        = "PENDING"
+	stateAwaitingReview = "AWAITING_REVIEW"
+	stateScreened       = "SCREENED"
+	statePlaced         = "PLACED"
+	stateAllocated      = "ALLOCATED"
+	stateAwaitingRx     = "AWAITING_PRESCRIPTION"
+	stateVerified       = "VERIFIED"
+	stateAuthorized     = "AUTHORIZED"
+	stateAwaitingPay    = "AWAITING_PAYMENT"
+	statePaid           = "PAID"
+	stateNotified       = "NOTIFIED"
+	stateCompleted      = "COMPLETED"
+	stateCompensating   = "COMPENSATING"
+	stateFailed         = "FAILED"
+	stateRefunded       = "REFUNDED"
+)
+
+// orderTransitions lists the states an order may move to from each state.
+var orderTransitions = map[string][]string{
+	statePending:        {stateAwaitingReview, stateScreened, stateCompensating},
+	stateAwaitingReview: {stateScreened, stateCompensating},
+	stateScreened:       {statePlaced, stateCompensating},
+	statePlaced:         {stateAllocated, stateCompensating},
+	stateAllocated:      {stateAwaitingRx, stateVerified, stateCompensating},
+	stateAwaitingRx:     {stateVerified, stateCompensating},
+	stateVerified:       {stateAuthorized, stateCompensating},
+	stateAuthorized:     {stateAwaitingPay, statePaid, stateCompensating},
+	stateAwaitingPay:    {statePaid, stateCompensating},
+	statePaid:           {stateNotified, stateCompensating},
+	stateNotified:       {stateCompleted, stateCompensating},
+	stateCompleted:      {stateRefunded},
+	stateCompensating:   {stateFailed},
+}
+
+const orderStateSchema = `
+ALTER TABLE sagas ADD COLUMN IF NOT EXISTS order_id TEXT;
+ALTER TABLE sagas ADD COLUMN IF NOT EXISTS user_id INTEGER;
+ALTER TABLE sagas ADD COLUMN IF NOT EXISTS state TEXT NOT NULL DEFAULT 'PENDING';
+ALTER TABLE sagas ADD COLUMN IF NOT EXISTS failure_reason TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS sagas_order_id_idx ON sagas (order_id);
+CREATE INDEX IF NOT EXISTS sagas_user_id_idx ON sagas (user_id);`
+
+type OrderStatus struct {
+	OrderID       string     `json:"order_id"`
+	UserID        int        `json:"user_id"`
+	State         string     `json:"state"`
+	FailureReason string     `json:"failure_reason,omitempty"`
+	Cart          []CartItem `json:"cart"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// fromStates returns the states an order may be in to move to state. An
+// order may also stay in state, so repeating a transition is harmless.
+func fromStates(state string) []string {
+	from := []string{state}
+	for s, next := range orderTransitions {
+		for _, n := range next {
+			if n == state {
+				from = append(from, s)
+			}
+		}
+	}
+	return from
+}
+
+// setOrderState moves the order of a saga to state if the state machine
+// allows it.
+func setOrderState(sagaID int, state string) {
+	res, err := db.Exec("UPDATE sagas SET state = $1, updated_at = NOW() WHERE id = $2 AND state = ANY($3)",
+		state, sagaID, pq.Array(fromStates(state)))
+	if err != nil {
+		log.Printf("Failed to set order state of saga %d to %s: %v", sagaID, state, err)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		log.Printf("Refusing invalid order state transition of saga %d to %s", sagaID, state)
+	}
+}
+
+func setFailureReason(sagaID int, reason string) {
+	_, err := db.Exec("UPDATE sagas SET failure_reason = $1, updated_at = NOW() WHERE id = $2", reason, sagaID)
+	if err != nil {
+		log.Printf("Failed to record failure reason of saga %d: %v", sagaID, err)
+	}
+}
+
+func scanOrderStatus(scan func(...any) error) (OrderStatus, error) {
+	var status OrderStatus
+	var payload []byte
+	var failureReason sql.NullString
+
+	err := scan(&status.OrderID, &status.UserID, &status.State, &failureReason, &payload,
+		&status.CreatedAt, &status.UpdatedAt)
+	if err != nil {
+		return status, err
+	}
+	status.FailureReason = failureReason.String
+
+	var order Order
+	if err := json.Unmarshal(payload, &order); err != nil {
+		return status, err
+	}
+	status.Cart = order.Cart
+
+	return status, nil
+}
+
+const orderStatusColumns = "order_id, user_id, state, failure_reason, payload, created_at, updated_at"
+
+func getOrder(w http.ResponseWriter, r *http.Request) {
+	log.Print("getOrder invoked")
+
+	orderID := r.PathValue("id")
+
+	// Other users' orders are reported as not found, except to staff.
+	user := auth.CurrentUser(r)
+	row := db.QueryRow("SELECT "+orderStatusColumns+" FROM sagas WHERE order_id = $1 AND (user_id = $2 OR $3)",
+		orderID, user.ID, user.HasRole(auth.RolePharmacist, auth.RoleAdmin))
+	status, err := scanOrderStatus(row.Scan)
+	if err == sql.ErrNoRows {
+		writeError(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading order %s: %v", orderID, err)
+		writeError(w, "Error fetching order", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func listOrders(w http.ResponseWriter, r *http.Request) {
+	log.Print("listOrders invoked")
+
+	userID := auth.CurrentUser(r).ID
+	if param := r.URL.Query().Get("userID"); param != "" && param != strconv.Itoa(userID) {
+		writeError(w, "userID does not match the authenticated user", http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.Query("SELECT "+orderStatusColumns+" FROM sagas WHERE user_id = $1 ORDER BY created_at DESC", userID)
+	if err != nil {
+		log.Printf("Error listing orders of user %d: %v", userID, err)
+		writeError(w, "Error fetching orders", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	orders := []OrderStatus{}
+	for rows.Next() {
+		status, err := scanOrderStatus(rows.Scan)
+		if err != nil {
+			log.Printf("Error scanning order: %v", err)
+			writeError(w, "Error fetching orders", http.StatusInternalServerError)
+			return
+		}
+		orders = append(orders, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+// refundOrder refunds the payment of a completed order.
+func refundOrder(w http.ResponseWriter, r *http.Request) {
+	log.Print("refundOrder invoked")
+
+	orderID := r.PathValue("id")
+
+	var sagaID int
+	var state string
+	var payload []byte
+	var order Order
+	err := db.QueryRow("SELECT id, state, payload, COALESCE(idempotency_key, '') FROM sagas WHERE order_id = $1",
+		orderID).Scan(&sagaID, &state, &payload, &order.IdempotencyKey)
+	if err == sql.ErrNoRows {
+		writeError(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading order %s: %v", orderID, err)
+		writeError(w, "Error fetching order", http.StatusInternalServerError)
+		return
+	}
+
+	if state != stateCompleted {
+		writeError(w, fmt.Sprintf("Order is %s, only completed orders can be refunded", state), http.StatusConflict)
+		return
+	}
+
+	if err := json.Unmarshal(payload, &order); err != nil {
+		log.Printf("Error decoding payload of saga %d: %v", sagaID, err)
+		writeError(w, "Error fetching order", http.StatusInternalServerError)
+		return
+	}
+
+	if !refundPaymentService(order) {
+		writeError(w, "Failed to refund payment", http.StatusBadGateway)
+		return
+	}
+	setOrderState(sagaID, stateRefunded)
+
+	log.Printf("Order %s refunded by user %d", orderID, auth.CurrentUser(r).ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":  "Order refunded",
+		"order_id": orderID,
+	})
+}
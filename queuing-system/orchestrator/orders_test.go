@@ -0,0 +1,98 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func canMove(from, to string) bool {
+	return slices.Contains(fromStates(to), from)
+}
+
+func TestFromStates(t *testing.T) {
+	tests := []struct {
+		state string
+		want  []string
+	}{
+		{statePending, []string{statePending}},
+		{stateAwaitingReview, []string{stateAwaitingReview, statePending}},
+		{stateScreened, []string{stateScreened, statePending, stateAwaitingReview}},
+		{stateVerified, []string{stateVerified, stateAllocated, stateAwaitingRx}},
+		{statePaid, []string{statePaid, stateAuthorized, stateAwaitingPay}},
+		{stateCompleted, []string{stateCompleted, stateNotified}},
+		{stateRefunded, []string{stateRefunded, stateCompleted}},
+		{stateFailed, []string{stateFailed, stateCompensating}},
+		{stateCompensating, []string{
+			stateCompensating, statePending, stateAwaitingReview, stateScreened, statePlaced,
+			stateAllocated, stateAwaitingRx, stateVerified, stateAuthorized, stateAwaitingPay, statePaid,
+			stateNotified,
+		}},
+	}
+
+	for _, tt := range tests {
+		got := fromStates(tt.state)
+		slices.Sort(got)
+		want := slices.Clone(tt.want)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("fromStates(%s) = %v, want %v", tt.state, got, want)
+		}
+	}
+}
+
+func TestOrderTransitions(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{statePending, stateScreened, true},
+		{statePending, stateAwaitingReview, true},
+		{statePending, statePlaced, false},
+		{statePlaced, statePlaced, true},
+		{stateAllocated, stateAwaitingRx, true},
+		{stateAwaitingRx, statePaid, false},
+		{stateAwaitingPay, statePaid, true},
+		{stateVerified, statePaid, false},
+		{stateNotified, stateCompleted, true},
+		{stateCompleted, stateCompensating, false},
+		{stateCompleted, stateRefunded, true},
+		{stateFailed, stateRefunded, false},
+		{stateFailed, statePending, false},
+		{stateRefunded, stateCompleted, false},
+		{stateCompensating, stateFailed, true},
+		{stateCompensating, stateCompleted, false},
+	}
+
+	for _, tt := range tests {
+		if got := canMove(tt.from, tt.to); got != tt.want {
+			t.Errorf("%s -> %s allowed = %t, want %t", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+// Every state a saga step moves the order to must be reachable from the
+// state the previous step left it in, and every step must be able to fail.
+func TestSagaStepsFollowOrderTransitions(t *testing.T) {
+	state := statePending
+	for _, step := range sagaSteps {
+		if step.waitState != "" {
+			if !canMove(state, step.waitState) {
+				t.Errorf("step %s: cannot wait in %s after %s", step.name, step.waitState, state)
+			}
+			if !canMove(step.waitState, step.state) {
+				t.Errorf("step %s: cannot move from %s to %s", step.name, step.waitState, step.state)
+			}
+		}
+		if !canMove(state, step.state) {
+			t.Errorf("step %s: cannot move from %s to %s", step.name, state, step.state)
+		}
+		if !canMove(state, stateCompensating) {
+			t.Errorf("step %s: cannot compensate from %s", step.name, state)
+		}
+		state = step.state
+	}
+
+	if state != stateCompleted {
+		t.Errorf("last step leaves the order in %s, want %s", state, stateCompleted)
+	}
+}
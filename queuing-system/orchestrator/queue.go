@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"shared/auth"
+	"shared/messaging"
+)
+
+// confirmQueue carries accepted orders from confirmOrder to the saga
+// runner.
+const confirmQueue = "orders.confirm"
+
+type service struct {
+	// queue is where the service consumes its requests from.
+	queue string
+	// url is the service's HTTP address, used by the in-process broker.
+	url string
+}
+
+var services = map[string]service{
+	"placeorder":   {"placeorder.requests", "http://localhost:9003"},
+	"payment":      {"payment.requests", "http://localhost:8006"},
+	"notification": {"notification.requests", "http://localhost:8004"},
+	"prescription": {"prescription.requests", "http://localhost:8008"},
+	"removedb":     {"removedb.requests", "http://localhost:8007"},
+}
+
+type serviceResponse struct {
+	StatusCode int
+	Body       []byte
+}
+
+var (
+	broker      messaging.Broker
+	replyQueue  string
+	stepTimeout = 30 * time.Second
+
+	pendingMu sync.Mutex
+	pending   = make(map[string]chan serviceResponse)
+)
+
+// initBroker connects to the AMQP server in AMQP_URL, or falls back to the
+// in-process broker with every service queue bridged to the service's HTTP
+// endpoint.
+func initBroker() error {
+	if timeout := os.Getenv("STEP_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid STEP_TIMEOUT %q", timeout)
+		}
+		stepTimeout = d
+	}
+
+	if url := os.Getenv("AMQP_URL"); url != "" {
+		b, err := messaging.NewAMQPBroker(url)
+		if err != nil {
+			return err
+		}
+		broker = b
+
+		// Requests published before a service has started consuming are
+		// kept in its queue.
+		for _, svc := range services {
+			if err := broker.Declare(svc.queue); err != nil {
+				return err
+			}
+		}
+	} else {
+		log.Println("AMQP_URL not set, using the in-process broker")
+		broker = messaging.NewMemoryBroker()
+		for _, svc := range services {
+			if err := bridgeToHTTP(svc); err != nil {
+				return err
+			}
+		}
+	}
+
+	var err error
+	replyQueue, err = broker.ConsumeTemporary(handleReply)
+	return err
+}
+
+type confirmMessage struct {
+	SagaID int `json:"saga_id"`
+}
+
+func enqueueSaga(sagaID int) error {
+	body, err := json.Marshal(confirmMessage{SagaID: sagaID})
+	if err != nil {
+		return err
+	}
+	return broker.Publish(confirmQueue, messaging.Message{Body: body})
+}
+
+func consumeConfirmations() error {
+	return broker.Consume(confirmQueue, func(msg messaging.Message) error {
+		var confirm confirmMessage
+		if err := json.Unmarshal(msg.Body, &confirm); err != nil {
+			log.Printf("Dropping malformed confirmation message: %v", err)
+			return nil
+		}
+		return resumeSaga(confirm.SagaID)
+	})
+}
+
+// requestService sends a request to one of the services on behalf of a
+// user over the broker and waits for its result event.
+func requestService(name, path string, body []byte, idempotencyKey string, userID int) (*serviceResponse, error) {
+	svc, ok := services[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown service %s", name)
+	}
+
+	token, err := auth.ServiceToken("orchestrator", userID)
+	if err != nil {
+		return nil, fmt.Errorf("error issuing service token: %w", err)
+	}
+
+	correlationID, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make(chan serviceResponse, 1)
+	pendingMu.Lock()
+	pending[correlationID] = reply
+	pendingMu.Unlock()
+
+	defer func() {
+		pendingMu.Lock()
+		delete(pending, correlationID)
+		pendingMu.Unlock()
+	}()
+
+	err = broker.Publish(svc.queue, messaging.Message{
+		Headers: map[string]string{
+			"Path":            path,
+			"Idempotency-Key": idempotencyKey,
+			"Authorization":   "Bearer " + token,
+			"Correlation-Id":  correlationID,
+			"Reply-To":        replyQueue,
+		},
+		Body: body,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error publishing to %s: %w", svc.queue, err)
+	}
+
+	select {
+	case resp := <-reply:
+		return &resp, nil
+	case <-time.After(stepTimeout):
+		return nil, fmt.Errorf("timed out waiting for %s%s", name, path)
+	}
+}
+
+func handleReply(msg messaging.Message) error {
+	correlationID := msg.Headers["Correlation-Id"]
+
+	pendingMu.Lock()
+	reply, ok := pending[correlationID]
+	pendingMu.Unlock()
+
+	if !ok {
+		log.Printf("Dropping result %s that nobody is waiting for", correlationID)
+		return nil
+	}
+
+	statusCode, _ := strconv.Atoi(msg.Headers["Status"])
+	reply <- serviceResponse{StatusCode: statusCode, Body: msg.Body}
+	return nil
+}
+
+// bridgeToHTTP serves a service's queue by forwarding each request to the
+// service over HTTP. It stands in for the service's own queue consumer
+// when there is no AMQP server.
+func bridgeToHTTP(svc service) error {
+	return broker.Consume(svc.queue, func(msg messaging.Message) error {
+		reply := messaging.Message{Headers: map[string]string{"Correlation-Id": msg.Headers["Correlation-Id"]}}
+
+		resp, err := makeRequest("POST", svc.url+msg.Headers["Path"], msg.Body, msg.Headers["Idempotency-Key"],
+			msg.Headers["Authorization"])
+		if err != nil {
+			reply.Headers["Status"] = strconv.Itoa(http.StatusBadGateway)
+		} else {
+			defer resp.Body.Close()
+			reply.Headers["Status"] = strconv.Itoa(resp.StatusCode)
+			reply.Body, _ = io.ReadAll(resp.Body)
+		}
+
+		return broker.Publish(msg.Headers["Reply-To"], reply)
+	})
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Saga statuses stored in the sagas table.
+const (
+	sagaRunning      = "RUNNING"
+	sagaCompensating = "COMPENSATING"
+	sagaCompleted    = "COMPLETED"
+	sagaCompensated  = "COMPENSATED"
+)
+
+// Step statuses stored in the saga_steps table.
+const (
+	stepStarted     = "STARTED"
+	stepSucceeded   = "SUCCEEDED"
+	stepFailed      = "FAILED"
+	stepCompensated = "COMPENSATED"
+
+	stepCompensationFailed = "COMPENSATION_FAILED"
+)
+
+const sagaSchema = `
+CREATE TABLE IF NOT EXISTS sagas (
+	id SERIAL PRIMARY KEY,
+	payload JSONB NOT NULL,
+	status TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+ALTER TABLE sagas ADD COLUMN IF NOT EXISTS idempotency_key TEXT;
+CREATE TABLE IF NOT EXISTS saga_steps (
+	id SERIAL PRIMARY KEY,
+	saga_id INTEGER NOT NULL REFERENCES sagas(id),
+	step TEXT NOT NULL,
+	status TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);`
+
+type sagaStep struct {
+	name           string
+	call           func(*Order) bool
+	compensate     func(Order) bool
+	failureMessage string
+	// state is the order state reached once the step succeeded.
+	state string
+
+	// ready, if set, is asked before the step runs whether it can run yet.
+	// If not, the saga parks the order in waitState and is resumed later
+	// by resumeWaitingSagas. An error fails the step.
+	ready     func(*Order) (bool, error)
+	waitState string
+}
+
+// sagaSteps are the forward steps of confirmOrder, executed in order. Each
+// step is paired with the call that undoes it.
+var sagaSteps = []sagaStep{
+	{name: "interactions", call: screenInteractions, compensate: noCompensation,
+		failureMessage: "Failed to check drug interactions", state: stateScreened,
+		ready: checkInteractions, waitState: stateAwaitingReview},
+	{name: "placeorder", call: callPlaceOrderService, compensate: rollbackPlaceOrderService,
+		failureMessage: "Failed to place order", state: statePlaced},
+	{name: "inventory", call: callInventoryService, compensate: releaseInventoryService,
+		failureMessage: "Not enough stock for the order", state: stateAllocated},
+	{name: "prescription", call: callPrescriptionService, compensate: releasePrescriptionService,
+		failureMessage: "Prescription missing, rejected or expired", state: stateVerified,
+		ready: checkPrescriptionService, waitState: stateAwaitingRx},
+	{name: "authorize", call: callAuthorizeService, compensate: voidPaymentService,
+		failureMessage: "Failed to process payment", state: stateAuthorized},
+	{name: "payment", call: callPaymentService, compensate: refundPaymentService,
+		failureMessage: "Failed to process payment", state: statePaid,
+		ready: checkPaymentService, waitState: stateAwaitingPay},
+	{name: "notification", call: callNotificationService, compensate: cancelNotificationService,
+		failureMessage: "Failed to send notification", state: stateNotified},
+	{name: "removedb", call: callRemoveDBService, compensate: rollbackRemoveDBService,
+		failureMessage: "Failed to remove from DB", state: stateCompleted},
+}
+
+// waitPollInterval is how often parked sagas check whether they can go on.
+var waitPollInterval = 30 * time.Second
+
+func initSagaLog() error {
+	_, err := db.Exec(sagaSchema)
+	if err != nil {
+		return fmt.Errorf("error creating saga tables: %w", err)
+	}
+
+	_, err = db.Exec(orderStateSchema)
+	if err != nil {
+		return fmt.Errorf("error adding order state to saga table: %w", err)
+	}
+	return nil
+}
+
+// startSaga records a new saga for order. The saga's downstream
+// idempotency key is derived from the key of the confirm request and the
+// saga ID: a retried confirm that starts a new saga, because the first one
+// failed, must not have the failed saga's responses replayed to it.
+func startSaga(order *Order, requestKey string) (int, error) {
+	var sagaID int
+	err := db.QueryRow("SELECT nextval(pg_get_serial_sequence('sagas', 'id'))").Scan(&sagaID)
+	if err != nil {
+		return 0, fmt.Errorf("error allocating saga ID: %w", err)
+	}
+	order.IdempotencyKey = fmt.Sprintf("%s-%d", requestKey, sagaID)
+
+	payload, err := json.Marshal(order)
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling order: %w", err)
+	}
+
+	_, err = db.Exec(`INSERT INTO sagas (id, payload, status, idempotency_key, order_id, user_id, state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		sagaID, payload, sagaRunning, order.IdempotencyKey, order.OrderID, order.UserID, statePending)
+	if err != nil {
+		return 0, fmt.Errorf("error inserting saga: %w", err)
+	}
+
+	return sagaID, nil
+}
+
+func saveSagaOrder(sagaID int, order Order) {
+	payload, err := json.Marshal(order)
+	if err != nil {
+		log.Printf("Failed to marshal order of saga %d: %v", sagaID, err)
+		return
+	}
+
+	_, err = db.Exec("UPDATE sagas SET payload = $1, updated_at = NOW() WHERE id = $2", payload, sagaID)
+	if err != nil {
+		log.Printf("Failed to save order of saga %d: %v", sagaID, err)
+	}
+}
+
+func logStep(sagaID int, step, status string) error {
+	_, err := db.Exec("INSERT INTO saga_steps (saga_id, step, status) VALUES ($1, $2, $3)",
+		sagaID, step, status)
+	if err != nil {
+		log.Printf("Failed to log step %s=%s for saga %d: %v", step, status, sagaID, err)
+	}
+	return err
+}
+
+func setSagaStatus(sagaID int, status string) {
+	_, err := db.Exec("UPDATE sagas SET status = $1, updated_at = NOW() WHERE id = $2", status, sagaID)
+	if err != nil {
+		log.Printf("Failed to set saga %d status to %s: %v", sagaID, status, err)
+	}
+}
+
+// runSaga executes sagaSteps starting at index from. A step is only called
+// once its STARTED record is durable, so a crash always leaves a trace of
+// the step that was in flight. On failure the saga is compensated and the
+// failed step is returned.
+func runSaga(sagaID int, order *Order, from int) (sagaStep, bool) {
+	for i := from; i < len(sagaSteps); i++ {
+		step := sagaSteps[i]
+
+		if step.ready != nil {
+			ready, err := step.ready(order)
+			if err != nil {
+				log.Printf("Step %s of saga %d cannot run: %v", step.name, sagaID, err)
+				logStep(sagaID, step.name, stepFailed)
+				reason := step.failureMessage
+				if order.FailureReason != "" {
+					reason = order.FailureReason
+				}
+				setFailureReason(sagaID, reason)
+				compensateSaga(sagaID, *order, i)
+				return step, false
+			}
+			if !ready {
+				log.Printf("Saga %d is waiting before step %s", sagaID, step.name)
+				setOrderState(sagaID, step.waitState)
+				return step, true
+			}
+		}
+
+		if logStep(sagaID, step.name, stepStarted) != nil || !step.call(order) {
+			logStep(sagaID, step.name, stepFailed)
+			reason := step.failureMessage
+			if order.FailureReason != "" {
+				reason = order.FailureReason
+			}
+			setFailureReason(sagaID, reason)
+			compensateSaga(sagaID, *order, i)
+			return step, false
+		}
+
+		// Steps may fill in the order, e.g. with its order ID, and later
+		// steps and compensations depend on that after a restart.
+		saveSagaOrder(sagaID, *order)
+		logStep(sagaID, step.name, stepSucceeded)
+		setOrderState(sagaID, step.state)
+	}
+
+	setSagaStatus(sagaID, sagaCompleted)
+	return sagaStep{}, true
+}
+
+// compensateSaga undoes the first done steps of a saga in reverse order.
+// Steps already compensated in an earlier attempt are skipped. If any
+// compensation fails the saga stays COMPENSATING so the next startup
+// retries it.
+func compensateSaga(sagaID int, order Order, done int) {
+	setSagaStatus(sagaID, sagaCompensating)
+	setOrderState(sagaID, stateCompensating)
+
+	progress, err := loadSagaProgress(sagaID)
+	if err != nil {
+		log.Printf("Error reading steps of saga %d: %v", sagaID, err)
+		return
+	}
+
+	complete := true
+	for i := done - 1; i >= 0; i-- {
+		step := sagaSteps[i]
+		if progress.compensated[step.name] {
+			continue
+		}
+
+		if !step.compensate(order) {
+			log.Printf("Failed to compensate step %s of saga %d", step.name, sagaID)
+			logStep(sagaID, step.name, stepCompensationFailed)
+			complete = false
+			continue
+		}
+		logStep(sagaID, step.name, stepCompensated)
+	}
+
+	if complete {
+		setSagaStatus(sagaID, sagaCompensated)
+		setOrderState(sagaID, stateFailed)
+	}
+}
+
+type sagaProgress struct {
+	// done is the number of leading steps that succeeded.
+	done int
+	// failed reports whether the step after them is recorded as failed.
+	failed      bool
+	compensated map[string]bool
+}
+
+// loadSagaProgress reads the step log of a saga.
+func loadSagaProgress(sagaID int) (sagaProgress, error) {
+	progress := sagaProgress{compensated: make(map[string]bool)}
+
+	rows, err := db.Query("SELECT step, status FROM saga_steps WHERE saga_id = $1 ORDER BY id", sagaID)
+	if err != nil {
+		return progress, err
+	}
+	defer rows.Close()
+
+	succeeded := make(map[string]bool)
+	failed := make(map[string]bool)
+	for rows.Next() {
+		var step, status string
+		if err := rows.Scan(&step, &status); err != nil {
+			return progress, err
+		}
+		switch status {
+		case stepSucceeded:
+			succeeded[step] = true
+		case stepFailed:
+			failed[step] = true
+		case stepCompensated:
+			progress.compensated[step] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return progress, err
+	}
+
+	for progress.done < len(sagaSteps) && succeeded[sagaSteps[progress.done].name] {
+		progress.done++
+	}
+	progress.failed = progress.done < len(sagaSteps) && failed[sagaSteps[progress.done].name]
+
+	return progress, nil
+}
+
+var (
+	runningMu sync.Mutex
+	running   = make(map[int]bool)
+)
+
+// resumeSaga runs saga sagaID from wherever its log says it stopped. Sagas
+// that were compensating, or whose last step failed, are compensated; all
+// others resume at the first step without a SUCCEEDED record. A step that
+// was STARTED but never finished is called again with the saga's
+// idempotency key, so the service replays it if it had already run.
+// Finished sagas are left alone, so redelivered messages are harmless.
+func resumeSaga(sagaID int) error {
+	runningMu.Lock()
+	if running[sagaID] {
+		runningMu.Unlock()
+		return nil
+	}
+	running[sagaID] = true
+	runningMu.Unlock()
+
+	defer func() {
+		runningMu.Lock()
+		delete(running, sagaID)
+		runningMu.Unlock()
+	}()
+
+	var order Order
+	var payload []byte
+	var status string
+	err := db.QueryRow("SELECT payload, status, COALESCE(idempotency_key, '') FROM sagas WHERE id = $1",
+		sagaID).Scan(&payload, &status, &order.IdempotencyKey)
+	if err == sql.ErrNoRows {
+		log.Printf("Saga %d does not exist", sagaID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error loading saga %d: %w", sagaID, err)
+	}
+
+	if status != sagaRunning && status != sagaCompensating {
+		return nil
+	}
+
+	if err := json.Unmarshal(payload, &order); err != nil {
+		log.Printf("Error decoding payload of saga %d: %v", sagaID, err)
+		return nil
+	}
+
+	progress, err := loadSagaProgress(sagaID)
+	if err != nil {
+		return fmt.Errorf("error reading steps of saga %d: %w", sagaID, err)
+	}
+
+	if status == sagaCompensating || progress.failed {
+		log.Printf("Compensating saga %d after %d completed steps", sagaID, progress.done)
+		compensateSaga(sagaID, order, progress.done)
+		return nil
+	}
+
+	if failed, ok := runSaga(sagaID, &order, progress.done); !ok {
+		log.Printf("Saga %d for order %s failed: %s", sagaID, order.OrderID, failed.failureMessage)
+	}
+	return nil
+}
+
+// recoverSagas finishes the sagas a previous run left behind. Their
+// confirmation messages are lost with the in-process broker, and may be
+// redelivered by an AMQP server, so they are resumed directly.
+func recoverSagas() {
+	rows, err := db.Query("SELECT id FROM sagas WHERE status IN ($1, $2) ORDER BY id",
+		sagaRunning, sagaCompensating)
+	if err != nil {
+		log.Printf("Error loading unfinished sagas: %v", err)
+		return
+	}
+
+	var pending []int
+	for rows.Next() {
+		var sagaID int
+		if err := rows.Scan(&sagaID); err != nil {
+			log.Printf("Error scanning saga: %v", err)
+			continue
+		}
+		pending = append(pending, sagaID)
+	}
+	rows.Close()
+
+	for _, sagaID := range pending {
+		log.Printf("Recovering saga %d", sagaID)
+		if err := resumeSaga(sagaID); err != nil {
+			log.Printf("Error recovering saga %d: %v", sagaID, err)
+		}
+	}
+}
+
+// resumeWaitingSagas periodically resumes the sagas parked by a step that
+// was not ready to run.
+func resumeWaitingSagas() {
+	if interval := os.Getenv("WAIT_POLL_INTERVAL"); interval != "" {
+		// time.Tick returns nil for intervals that are not positive, which
+		// would leave waiting sagas parked forever.
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			log.Printf("Invalid WAIT_POLL_INTERVAL %q, using %s", interval, waitPollInterval)
+		} else {
+			waitPollInterval = d
+		}
+	}
+
+	var waitStates []string
+	for _, step := range sagaSteps {
+		if step.waitState != "" {
+			waitStates = append(waitStates, step.waitState)
+		}
+	}
+
+	for range time.Tick(waitPollInterval) {
+		rows, err := db.Query("SELECT id FROM sagas WHERE status = $1 AND state = ANY($2) ORDER BY id",
+			sagaRunning, pq.Array(waitStates))
+		if err != nil {
+			log.Printf("Error loading waiting sagas: %v", err)
+			continue
+		}
+
+		var waiting []int
+		for rows.Next() {
+			var sagaID int
+			if err := rows.Scan(&sagaID); err == nil {
+				waiting = append(waiting, sagaID)
+			}
+		}
+		rows.Close()
+
+		for _, sagaID := range waiting {
+			if err := resumeSaga(sagaID); err != nil {
+				log.Printf("Error resuming saga %d: %v", sagaID, err)
+			}
+		}
+	}
+}
@@ -1,16 +1,33 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+
+	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
+
+	"shared/auth"
+	"shared/idempotency"
+	"shared/messaging"
 )
 
+var db *sql.DB
+var provider PaymentProvider
+
 type Order struct {
+	OrderID string    `json:"order_id"`
 	UserID  int       `json:"user_id"`
 	EmailID string    `json:"email_id"`
 	Cart    []CartItem `json:"cart"`
+	// TotalCents is the amount to charge.
+	TotalCents int64 `json:"total_cents"`
 }
 
 type CartItem struct {
@@ -18,15 +35,211 @@ type CartItem struct {
 	Quantity  int `json:"quantity"`
 }
 
+// Payment statuses stored in the payments table.
+const (
+	statusAuthorized        = "AUTHORIZED"
+	statusCaptured          = "CAPTURED"
+	statusRefunded          = "REFUNDED"
+	statusVoided            = "VOIDED"
+	statusDeclined          = "DECLINED"
+	statusChallengeRequired = "CHALLENGE_REQUIRED"
+	statusFailed            = "FAILED"
+)
+
+// Payment amounts are in cents.
+type Payment struct {
+	OrderID     string `json:"order_id"`
+	UserID      int    `json:"user_id"`
+	Amount      int64  `json:"amount"`
+	Status      string `json:"status"`
+	Provider    string `json:"provider"`
+	ProviderRef string `json:"provider_ref,omitempty"`
+}
+
+const paymentSchema = `
+CREATE TABLE IF NOT EXISTS payments (
+	order_id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	amount BIGINT NOT NULL,
+	status TEXT NOT NULL,
+	provider TEXT NOT NULL,
+	provider_ref TEXT,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);`
+
 func main() {
-	http.HandleFunc("/payment", paymentHandler)
+	var err error
+
+	err = godotenv.Load(".env")
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	err = InitDB()
+	if err != nil {
+		log.Fatalf("Error initializing database: %v", err)
+	}
+
+	err = auth.Init(db)
+	if err != nil {
+		log.Fatalf("Error initializing auth: %v", err)
+	}
+
+	err = idempotency.Init(db, "paymentservice")
+	if err != nil {
+		log.Fatalf("Error initializing idempotency store: %v", err)
+	}
+
+	provider, err = newProvider()
+	if err != nil {
+		log.Fatalf("Error initializing payment provider: %v", err)
+	}
+
+	// Payments are only moved by the orchestrator's saga, and refunds only
+	// after it has checked that staff asked for them.
+	http.HandleFunc("/payment/authorize", auth.RequireService(idempotency.Wrap(authorizeHandler), "orchestrator"))
+	http.HandleFunc("/payment/capture", auth.RequireService(idempotency.Wrap(captureHandler), "orchestrator"))
+	http.HandleFunc("/payment/refund", auth.RequireService(idempotency.Wrap(refundHandler), "orchestrator"))
+	http.HandleFunc("/payment/void", auth.RequireService(idempotency.Wrap(voidHandler), "orchestrator"))
+	http.HandleFunc("/payment/status", auth.RequireService(statusHandler, "orchestrator"))
+
+	// Customers answer the challenge their payment is waiting on.
+	http.HandleFunc("POST /payment/{orderId}/challenge", auth.RequireAuth(challengeHandler))
+
+	if url := os.Getenv("AMQP_URL"); url != "" {
+		broker, err := messaging.NewAMQPBroker(url)
+		if err != nil {
+			log.Fatalf("Error connecting to message broker: %v", err)
+		}
+		defer broker.Close()
+
+		err = messaging.Serve(broker, "payment.requests", http.DefaultServeMux)
+		if err != nil {
+			log.Fatalf("Error consuming requests: %v", err)
+		}
+	}
 
 	fmt.Println("Starting payment service at port 8006")
 	log.Fatal(http.ListenAndServe(":8006", nil))
 }
 
-func paymentHandler(w http.ResponseWriter, r *http.Request) {
-	log.Print("paymentHandler invoked")
+func InitDB() error {
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("DB_HOST"),
+		os.Getenv("DB_PORT"),
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_PASSWORD"),
+		os.Getenv("DB_NAME"))
+
+	var err error
+	db, err = sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("error connecting to the database: %w", err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return fmt.Errorf("error pinging the database: %w", err)
+	}
+
+	_, err = db.Exec(paymentSchema)
+	if err != nil {
+		return fmt.Errorf("error creating payments table: %w", err)
+	}
+
+	log.Println("Successfully connected to the database")
+	return nil
+}
+
+// newProvider returns the gateway named by PAYMENT_PROVIDER. Only the mock
+// gateway exists so far.
+func newProvider() (PaymentProvider, error) {
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "", "mock":
+		return newMockProvider()
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", name)
+	}
+}
+
+func loadPayment(orderID string) (Payment, error) {
+	var payment Payment
+	var providerRef sql.NullString
+	err := db.QueryRow("SELECT order_id, user_id, amount, status, provider, provider_ref FROM payments WHERE order_id = $1",
+		orderID).Scan(&payment.OrderID, &payment.UserID, &payment.Amount, &payment.Status, &payment.Provider, &providerRef)
+	payment.ProviderRef = providerRef.String
+	return payment, err
+}
+
+func savePayment(payment Payment) error {
+	_, err := db.Exec(`INSERT INTO payments (order_id, user_id, amount, status, provider, provider_ref)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (order_id) DO UPDATE SET amount = $3, status = $4, provider = $5, provider_ref = $6, updated_at = NOW()`,
+		payment.OrderID, payment.UserID, payment.Amount, payment.Status, payment.Provider, payment.ProviderRef)
+	return err
+}
+
+func setPaymentStatus(orderID, status string) error {
+	_, err := db.Exec("UPDATE payments SET status = $1, updated_at = NOW() WHERE order_id = $2", status, orderID)
+	return err
+}
+
+func writePayment(w http.ResponseWriter, statusCode int, message string, payment Payment) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]any{
+		"message": message,
+		"payment": payment,
+	})
+}
+
+// decodePaymentOrder reads the order from a payment request and loads its
+// payment record. It writes the error response itself and returns false
+// if the request cannot go on.
+func decodePaymentOrder(w http.ResponseWriter, r *http.Request) (Order, Payment, bool) {
+	var order Order
+	var payment Payment
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return order, payment, false
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&order)
+	if err != nil || order.OrderID == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return order, payment, false
+	}
+
+	if order.UserID != auth.CurrentUser(r).ID {
+		http.Error(w, "Order user does not match the authenticated user", http.StatusForbidden)
+		return order, payment, false
+	}
+
+	payment, err = loadPayment(order.OrderID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return order, payment, false
+	}
+	if err != nil {
+		log.Printf("Failed to load payment for order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to load payment", http.StatusInternalServerError)
+		return order, payment, false
+	}
+
+	if payment.UserID != order.UserID {
+		log.Printf("Rejecting request for payment of order %s by user %d, which belongs to user %d",
+			order.OrderID, order.UserID, payment.UserID)
+		http.Error(w, "Payment belongs to another user", http.StatusForbidden)
+		return order, payment, false
+	}
+
+	return order, payment, true
+}
+
+func authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Print("authorizeHandler invoked")
 
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
@@ -35,16 +248,276 @@ func paymentHandler(w http.ResponseWriter, r *http.Request) {
 
 	var order Order
 	err := json.NewDecoder(r.Body).Decode(&order)
+	if err != nil || order.OrderID == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if order.TotalCents < 0 {
+		http.Error(w, "Invalid amount", http.StatusBadRequest)
+		return
+	}
+
+	if order.UserID != auth.CurrentUser(r).ID {
+		http.Error(w, "Order user does not match the authenticated user", http.StatusForbidden)
+		return
+	}
+
+	log.Printf("Authorizing payment of %d for order %s", order.TotalCents, order.OrderID)
+
+	existing, err := loadPayment(order.OrderID)
+	if err == nil && existing.UserID != order.UserID {
+		log.Printf("Rejecting authorization of order %s for user %d, its payment belongs to user %d",
+			order.OrderID, order.UserID, existing.UserID)
+		http.Error(w, "Payment belongs to another user", http.StatusForbidden)
+		return
+	}
+	if err == nil && (existing.Status == statusAuthorized || existing.Status == statusCaptured) {
+		writePayment(w, http.StatusOK, "Payment already authorized", existing)
+		return
+	}
+	if err == nil && existing.Status == statusChallengeRequired {
+		writePayment(w, http.StatusAccepted, "Payment requires customer authentication", existing)
+		return
+	}
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to load payment for order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to load payment", http.StatusInternalServerError)
+		return
+	}
+
+	payment := Payment{
+		OrderID:  order.OrderID,
+		UserID:   order.UserID,
+		Amount:   order.TotalCents,
+		Provider: provider.Name(),
+	}
+
+	ref, authErr := provider.Authorize(order.OrderID, order.TotalCents)
+	statusCode, message := http.StatusOK, "Payment authorized"
+	switch {
+	case authErr == nil:
+		payment.Status = statusAuthorized
+		payment.ProviderRef = ref
+	case errors.Is(authErr, ErrDeclined):
+		payment.Status = statusDeclined
+		statusCode, message = http.StatusPaymentRequired, "Payment declined"
+	case errors.Is(authErr, ErrChallengeRequired):
+		// The order waits until the customer has answered the challenge.
+		payment.Status = statusChallengeRequired
+		payment.ProviderRef = ref
+		statusCode, message = http.StatusAccepted, "Payment requires customer authentication"
+	case errors.Is(authErr, ErrProviderTimeout):
+		payment.Status = statusFailed
+		statusCode, message = http.StatusGatewayTimeout, "Payment provider timed out"
+	default:
+		payment.Status = statusFailed
+		statusCode, message = http.StatusBadGateway, "Payment provider error"
+	}
+
+	err = savePayment(payment)
 	if err != nil {
+		log.Printf("Failed to save payment for order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to save payment", http.StatusInternalServerError)
+		return
+	}
+
+	if authErr != nil {
+		log.Printf("Authorization for order %s failed: %v", order.OrderID, authErr)
+	}
+	writePayment(w, statusCode, message, payment)
+}
+
+// statusHandler returns the payment of an order. The orchestrator polls it
+// while the customer has a challenge to answer, so it is not
+// idempotent-wrapped; a replayed answer would keep the order waiting.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	log.Print("statusHandler invoked")
+
+	_, payment, ok := decodePaymentOrder(w, r)
+	if !ok {
+		return
+	}
+	writePayment(w, http.StatusOK, "Payment "+strings.ToLower(payment.Status), payment)
+}
+
+// challengeHandler takes the customer's answer to the challenge their
+// payment is waiting on. A right answer authorizes the payment and a wrong
+// one declines it; the waiting order picks the outcome up on its next
+// check.
+func challengeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Print("challengeHandler invoked")
+
+	var challenge struct {
+		Answer string `json:"answer"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&challenge)
+	if err != nil || challenge.Answer == "" {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
 
-	// Simulate a successful payment
-	response := map[string]string{
-		"message": "Payment successful",
+	orderID := r.PathValue("orderId")
+	payment, err := loadPayment(orderID)
+	if err == sql.ErrNoRows || (err == nil && payment.UserID != auth.CurrentUser(r).ID) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load payment for order %s: %v", orderID, err)
+		http.Error(w, "Failed to load payment", http.StatusInternalServerError)
+		return
+	}
+	if payment.Status != statusChallengeRequired {
+		writePayment(w, http.StatusConflict, "Payment is not waiting for a challenge", payment)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	statusCode, message := http.StatusOK, "Payment authorized"
+	err = provider.CompleteChallenge(payment.ProviderRef, challenge.Answer)
+	switch {
+	case err == nil:
+		payment.Status = statusAuthorized
+	case errors.Is(err, ErrDeclined):
+		payment.Status = statusDeclined
+		statusCode, message = http.StatusPaymentRequired, "Payment declined"
+	default:
+		log.Printf("Challenge for order %s failed: %v", orderID, err)
+		writePayment(w, http.StatusBadGateway, "Payment provider error", payment)
+		return
+	}
+
+	res, err := db.Exec("UPDATE payments SET status = $1, updated_at = NOW() WHERE order_id = $2 AND status = $3",
+		payment.Status, orderID, statusChallengeRequired)
+	if err != nil {
+		log.Printf("Failed to save payment for order %s: %v", orderID, err)
+		http.Error(w, "Failed to save payment", http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		http.Error(w, "Payment is not waiting for a challenge", http.StatusConflict)
+		return
+	}
+
+	log.Printf("Challenge for order %s answered: %s", orderID, payment.Status)
+	writePayment(w, statusCode, message, payment)
+}
+
+func captureHandler(w http.ResponseWriter, r *http.Request) {
+	log.Print("captureHandler invoked")
+
+	order, payment, ok := decodePaymentOrder(w, r)
+	if !ok {
+		return
+	}
+
+	log.Printf("Capturing payment for order %s", order.OrderID)
+
+	switch payment.Status {
+	case statusCaptured:
+		writePayment(w, http.StatusOK, "Payment already captured", payment)
+		return
+	case statusAuthorized:
+	default:
+		writePayment(w, http.StatusConflict, "Payment is not authorized", payment)
+		return
+	}
+
+	err := provider.Capture(payment.ProviderRef, payment.Amount)
+	if err != nil {
+		log.Printf("Capture for order %s failed: %v", order.OrderID, err)
+		writePayment(w, http.StatusBadGateway, "Payment capture failed", payment)
+		return
+	}
+
+	payment.Status = statusCaptured
+	err = setPaymentStatus(payment.OrderID, payment.Status)
+	if err != nil {
+		log.Printf("Failed to save payment for order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to save payment", http.StatusInternalServerError)
+		return
+	}
+
+	writePayment(w, http.StatusOK, "Payment captured", payment)
+}
+
+// refundHandler gives the customer their money back: a captured payment is
+// refunded and one that was only authorized is voided.
+func refundHandler(w http.ResponseWriter, r *http.Request) {
+	log.Print("refundHandler invoked")
+
+	order, payment, ok := decodePaymentOrder(w, r)
+	if !ok {
+		return
+	}
+
+	log.Printf("Refunding payment for order %s", order.OrderID)
+
+	var err error
+	switch payment.Status {
+	case statusCaptured:
+		err = provider.Refund(payment.ProviderRef, payment.Amount)
+		payment.Status = statusRefunded
+	case statusAuthorized:
+		err = provider.Void(payment.ProviderRef)
+		payment.Status = statusVoided
+	default:
+		writePayment(w, http.StatusOK, "Nothing to refund", payment)
+		return
+	}
+	if err != nil {
+		log.Printf("Refund for order %s failed: %v", order.OrderID, err)
+		writePayment(w, http.StatusBadGateway, "Payment refund failed", payment)
+		return
+	}
+
+	err = setPaymentStatus(payment.OrderID, payment.Status)
+	if err != nil {
+		log.Printf("Failed to save payment for order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to save payment", http.StatusInternalServerError)
+		return
+	}
+
+	writePayment(w, http.StatusOK, "Payment refunded", payment)
+}
+
+func voidHandler(w http.ResponseWriter, r *http.Request) {
+	log.Print("voidHandler invoked")
+
+	order, payment, ok := decodePaymentOrder(w, r)
+	if !ok {
+		return
+	}
+
+	log.Printf("Voiding payment for order %s", order.OrderID)
+
+	switch payment.Status {
+	case statusVoided:
+		writePayment(w, http.StatusOK, "Payment already voided", payment)
+		return
+	case statusDeclined, statusFailed, statusRefunded:
+		writePayment(w, http.StatusOK, "Nothing to void", payment)
+		return
+	case statusAuthorized, statusChallengeRequired:
+	default:
+		writePayment(w, http.StatusConflict, "Only authorized payments can be voided", payment)
+		return
+	}
+
+	err := provider.Void(payment.ProviderRef)
+	if err != nil {
+		log.Printf("Void for order %s failed: %v", order.OrderID, err)
+		writePayment(w, http.StatusBadGateway, "Payment void failed", payment)
+		return
+	}
+
+	payment.Status = statusVoided
+	err = setPaymentStatus(payment.OrderID, payment.Status)
+	if err != nil {
+		log.Printf("Failed to save payment for order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to save payment", http.StatusInternalServerError)
+		return
+	}
+
+	writePayment(w, http.StatusOK, "Payment voided", payment)
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	ErrDeclined          = errors.New("payment declined")
+	ErrChallengeRequired = errors.New("payment requires a customer challenge")
+	ErrProviderTimeout   = errors.New("payment provider timed out")
+)
+
+// PaymentProvider is a payment gateway. Authorize places a hold for the
+// amount and returns the provider's reference for it; the other calls act
+// on that reference. If the customer has to pass a challenge first,
+// Authorize returns the reference with ErrChallengeRequired and the hold is
+// only placed once CompleteChallenge accepts the customer's answer.
+type PaymentProvider interface {
+	Name() string
+	Authorize(orderID string, amount int64) (string, error)
+	CompleteChallenge(ref, answer string) error
+	Capture(ref string, amount int64) error
+	Refund(ref string, amount int64) error
+	Void(ref string) error
+}
+
+// Behaviours of the mock provider, selected with MOCK_PAYMENT_BEHAVIOR.
+const (
+	mockApprove   = "approve"
+	mockDecline   = "decline"
+	mockTimeout   = "timeout"
+	mockChallenge = "challenge"
+)
+
+// mockProvider is a deterministic local gateway. Every authorization gets
+// the same answer, chosen by its behaviour; a challenge is passed by
+// answering challengeCode. Captures, refunds and voids always succeed.
+type mockProvider struct {
+	behavior      string
+	delay         time.Duration
+	challengeCode string
+}
+
+func newMockProvider() (*mockProvider, error) {
+	p := &mockProvider{behavior: mockApprove, delay: 2 * time.Second, challengeCode: "123456"}
+
+	if behavior := os.Getenv("MOCK_PAYMENT_BEHAVIOR"); behavior != "" {
+		switch behavior {
+		case mockApprove, mockDecline, mockTimeout, mockChallenge:
+			p.behavior = behavior
+		default:
+			return nil, fmt.Errorf("unknown MOCK_PAYMENT_BEHAVIOR %q", behavior)
+		}
+	}
+
+	if delay := os.Getenv("MOCK_PAYMENT_TIMEOUT"); delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MOCK_PAYMENT_TIMEOUT: %w", err)
+		}
+		p.delay = d
+	}
+
+	if code := os.Getenv("MOCK_CHALLENGE_CODE"); code != "" {
+		p.challengeCode = code
+	}
+
+	return p, nil
+}
+
+func (p *mockProvider) Name() string {
+	return "mock"
+}
+
+func (p *mockProvider) Authorize(orderID string, amount int64) (string, error) {
+	switch p.behavior {
+	case mockDecline:
+		return "", ErrDeclined
+	case mockTimeout:
+		time.Sleep(p.delay)
+		return "", ErrProviderTimeout
+	case mockChallenge:
+		return "mock_" + orderID, ErrChallengeRequired
+	}
+	return "mock_" + orderID, nil
+}
+
+func (p *mockProvider) CompleteChallenge(ref, answer string) error {
+	if answer != p.challengeCode {
+		return ErrDeclined
+	}
+	return nil
+}
+
+func (p *mockProvider) Capture(ref string, amount int64) error {
+	return nil
+}
+
+func (p *mockProvider) Refund(ref string, amount int64) error {
+	return nil
+}
+
+func (p *mockProvider) Void(ref string) error {
+	return nil
+}
@@ -3,6 +3,11 @@ module placeorderservice
 go 1.22.3
 
 require (
+	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
+	github.com/streadway/amqp v1.1.0
+	shared v0.0.0-00010101000000-000000000000
 )
+
+replace shared => ../shared
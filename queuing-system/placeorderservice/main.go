@@ -1,34 +1,50 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"sync"
+	"strconv"
 	"time"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+
+	"shared/auth"
+	"shared/carts"
+	"shared/idempotency"
+	"shared/messaging"
+	"shared/rules"
 )
 
 var db *sql.DB
-var mu sync.Mutex
 
+var taxRateBPS int64
+
+// Amounts are in cents.
 type CartItem struct {
-	UserID    int    `json:"user_id"`
-	EmailID   string `json:"email_id"`
-	ProductID int    `json:"product_id"`
-	Quantity  int    `json:"quantity"`
+	UserID         int    `json:"user_id"`
+	EmailID        string `json:"email_id"`
+	ProductID      int    `json:"product_id"`
+	Quantity       int    `json:"quantity"`
+	UnitPriceCents int64  `json:"unit_price_cents"`
+	LineTotalCents int64  `json:"line_total_cents"`
 }
 
 type Order struct {
-	UserID    int       `json:"user_id"`
-	EmailID   string    `json:"email_id"`
-	Cart      []CartItem `json:"cart"`
-	OrderDate time.Time `json:"order_date"`
+	OrderID       string    `json:"order_id"`
+	UserID        int       `json:"user_id"`
+	EmailID       string    `json:"email_id"`
+	Cart          []CartItem `json:"cart"`
+	OrderDate     time.Time `json:"order_date"`
+	SubtotalCents int64     `json:"subtotal_cents"`
+	TaxCents      int64     `json:"tax_cents"`
+	TotalCents    int64     `json:"total_cents"`
 }
 
 func main() {
@@ -44,12 +60,56 @@ func main() {
 		log.Fatalf("Error initializing database: %v", err)
 	}
 
+	err = auth.Init(db)
+	if err != nil {
+		log.Fatalf("Error initializing auth: %v", err)
+	}
+
+	err = initSchema()
+	if err != nil {
+		log.Fatalf("Error initializing schema: %v", err)
+	}
+
+	err = rules.Init(db)
+	if err != nil {
+		log.Fatalf("Error initializing purchase rules: %v", err)
+	}
+
+	err = carts.Init(db)
+	if err != nil {
+		log.Fatalf("Error initializing cart: %v", err)
+	}
+
+	if rate := os.Getenv("TAX_RATE_BPS"); rate != "" {
+		taxRateBPS, err = strconv.ParseInt(rate, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid TAX_RATE_BPS: %v", err)
+		}
+	}
+
+	err = idempotency.Init(db, "placeorderservice")
+	if err != nil {
+		log.Fatalf("Error initializing idempotency store: %v", err)
+	}
+
 	http.Handle("/", http.FileServer(http.Dir("./static")))
 
-	http.HandleFunc("/placeorder", placeOrder)
-	http.HandleFunc("/rollback", rollbackOrder)
-	http.HandleFunc("/cart", getCart)
-	http.HandleFunc("/cancel", cancelCart)
+	// Called by the orchestrator for each order.
+	http.HandleFunc("/placeorder", auth.RequireService(idempotency.Wrap(placeOrder), "orchestrator"))
+	http.HandleFunc("/rollback", auth.RequireService(idempotency.Wrap(rollbackOrder), "orchestrator"))
+
+	if url := os.Getenv("AMQP_URL"); url != "" {
+		broker, err := messaging.NewAMQPBroker(url)
+		if err != nil {
+			log.Fatalf("Error connecting to message broker: %v", err)
+		}
+		defer broker.Close()
+
+		err = messaging.Serve(broker, "placeorder.requests", http.DefaultServeMux)
+		if err != nil {
+			log.Fatalf("Error consuming requests: %v", err)
+		}
+	}
 
 	fmt.Printf("Starting server at port 9003\n")
 	log.Fatal(http.ListenAndServe(":9003", nil))
@@ -78,53 +138,40 @@ func InitDB() error {
 	return nil
 }
 
-func getCart(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("userID")
-	if userID == "" {
-		http.Error(w, "Missing userID parameter", http.StatusBadRequest)
-		return
-	}
-
-	rows, err := db.Query("SELECT product_id, quantity FROM cart WHERE user_id = $1", userID)
+// order_headers holds one row per placed order; the per-product lines in
+// orders point at it through order_id. Lines keep the unit price the
+// product had when the order was placed, so later price changes do not
+// alter the order.
+const orderSchema = `
+CREATE TABLE IF NOT EXISTS order_headers (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	email TEXT NOT NULL,
+	order_date TIMESTAMP NOT NULL
+);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS order_id TEXT REFERENCES order_headers(id);
+CREATE INDEX IF NOT EXISTS orders_order_id_idx ON orders (order_id);
+ALTER TABLE products ADD COLUMN IF NOT EXISTS price_cents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS unit_price_cents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS line_total_cents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE order_headers ADD COLUMN IF NOT EXISTS subtotal_cents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE order_headers ADD COLUMN IF NOT EXISTS tax_cents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE order_headers ADD COLUMN IF NOT EXISTS total_cents BIGINT NOT NULL DEFAULT 0;`
+
+func initSchema() error {
+	_, err := db.Exec(orderSchema)
 	if err != nil {
-		http.Error(w, "Error fetching cart items", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var cartItems []CartItem
-	for rows.Next() {
-		var item CartItem
-		if err := rows.Scan(&item.ProductID, &item.Quantity); err != nil {
-			http.Error(w, "Error scanning cart item", http.StatusInternalServerError)
-			return
-		}
-		cartItems = append(cartItems, item)
+		return fmt.Errorf("error creating order tables: %w", err)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(cartItems)
+	return nil
 }
 
-func cancelCart(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("userID")
-	if userID == "" {
-		http.Error(w, "Missing userID parameter", http.StatusBadRequest)
-		return
+func newOrderID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-
-	_, err := db.Exec("DELETE FROM cart WHERE user_id = $1", userID)
-	if err != nil {
-		http.Error(w, "Error deleting cart items", http.StatusInternalServerError)
-		return
-	}
-
-	response := map[string]string{
-		"message": "Cart items deleted successfully!",
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	return hex.EncodeToString(b), nil
 }
 
 func placeOrder(w http.ResponseWriter, r *http.Request) {
@@ -142,33 +189,107 @@ func placeOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if order.UserID != auth.CurrentUser(r).ID {
+		http.Error(w, "Order user does not match the authenticated user", http.StatusForbidden)
+		return
+	}
+
+	for _, item := range order.Cart {
+		if item.Quantity < 1 {
+			http.Error(w, fmt.Sprintf("Invalid quantity for product ID %d", item.ProductID), http.StatusBadRequest)
+			return
+		}
+	}
+
 	order.OrderDate = time.Now()
 
+	// The orchestrator assigns the order ID up front so it can hand it to
+	// the customer before the order is placed.
+	if order.OrderID == "" {
+		order.OrderID, err = newOrderID()
+		if err != nil {
+			log.Printf("Failed to generate order ID: %v", err)
+			http.Error(w, "Failed to place order", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
 		return
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
+	// The cart was checked as it was filled, but the customer may have
+	// bought more since then. The user's orders are placed one at a time
+	// so that two of them cannot both fit under a per-period limit that
+	// only one fits under.
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext('purchase_rules'), $1)", order.UserID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to lock purchases of user %d: %v", order.UserID, err)
+		http.Error(w, "Failed to place order", http.StatusInternalServerError)
+		return
+	}
+	lines := make([]rules.Line, len(order.Cart))
+	for i, item := range order.Cart {
+		lines[i] = rules.Line{ProductID: item.ProductID, Quantity: item.Quantity}
+	}
+	violations, err := rules.Check(tx, order.UserID, order.OrderID, lines)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to check purchase rules for order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to place order", http.StatusInternalServerError)
+		return
+	}
+	if len(violations) > 0 {
+		tx.Rollback()
+		log.Printf("Refused order %s: %v", order.OrderID, violations)
+		rules.WriteViolations(w, violations)
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO order_headers (id, user_id, email, order_date) VALUES ($1, $2, $3, $4)",
+		order.OrderID, order.UserID, order.EmailID, order.OrderDate)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to create order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to place order", http.StatusInternalServerError)
+		return
+	}
 
-	for _, item := range order.Cart {
-		var availableQuantity int
-		err = tx.QueryRow("SELECT quantity FROM products WHERE id = $1", item.ProductID).Scan(&availableQuantity)
+	for i := range order.Cart {
+		item := &order.Cart[i]
+
+		// Stock is checked and allocated by removedb's inventory API in the
+		// next step of the saga.
+		err = tx.QueryRow("SELECT price_cents FROM products WHERE id = $1", item.ProductID).
+			Scan(&item.UnitPriceCents)
+		if err == sql.ErrNoRows {
+			tx.Rollback()
+			http.Error(w, fmt.Sprintf("Product ID %d not found", item.ProductID), http.StatusNotFound)
+			return
+		}
 		if err != nil {
 			tx.Rollback()
-			http.Error(w, "Product not found", http.StatusInternalServerError)
+			log.Printf("Failed to price product %d: %v", item.ProductID, err)
+			http.Error(w, "Failed to place order", http.StatusInternalServerError)
 			return
 		}
-		if availableQuantity < item.Quantity {
+		// Products are not priced until they are put on sale.
+		if item.UnitPriceCents <= 0 {
 			tx.Rollback()
-			http.Error(w, fmt.Sprintf("Insufficient quantity for product ID %d", item.ProductID), http.StatusBadRequest)
+			http.Error(w, fmt.Sprintf("Product ID %d is not for sale yet", item.ProductID), http.StatusUnprocessableEntity)
 			return
 		}
 
-		_, err = tx.Exec("INSERT INTO orders (user_id, product_id, quantity, email, order_date) VALUES ($1, $2, $3, $4, $5)",
-			order.UserID, item.ProductID, item.Quantity, order.EmailID, order.OrderDate)
+		item.LineTotalCents = item.UnitPriceCents * int64(item.Quantity)
+		order.SubtotalCents += item.LineTotalCents
+
+		_, err = tx.Exec(`INSERT INTO orders (order_id, user_id, product_id, quantity, email, order_date, unit_price_cents, line_total_cents)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			order.OrderID, order.UserID, item.ProductID, item.Quantity, order.EmailID, order.OrderDate,
+			item.UnitPriceCents, item.LineTotalCents)
 		if err != nil {
 			tx.Rollback()
 			log.Printf("Failed to place order: %v", err)
@@ -186,6 +307,19 @@ func placeOrder(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Tax is rounded half up to the nearest cent.
+	order.TaxCents = (order.SubtotalCents*taxRateBPS + 5000) / 10000
+	order.TotalCents = order.SubtotalCents + order.TaxCents
+
+	_, err = tx.Exec("UPDATE order_headers SET subtotal_cents = $1, tax_cents = $2, total_cents = $3 WHERE id = $4",
+		order.SubtotalCents, order.TaxCents, order.TotalCents, order.OrderID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to save totals of order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to place order", http.StatusInternalServerError)
+		return
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		log.Printf("Failed to commit transaction: %v", err)
@@ -193,8 +327,14 @@ func placeOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := map[string]string{
-		"message": "Order placed successfully!",
+	log.Printf("Placed order %s for user %d, total %d", order.OrderID, order.UserID, order.TotalCents)
+	response := map[string]any{
+		"message":        "Order placed successfully!",
+		"order_id":       order.OrderID,
+		"cart":           order.Cart,
+		"subtotal_cents": order.SubtotalCents,
+		"tax_cents":      order.TaxCents,
+		"total_cents":    order.TotalCents,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -216,8 +356,17 @@ func rollbackOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Debugging: Print the decoded order details
-	log.Printf("Decoded order: %+v", order)
+	if order.UserID != auth.CurrentUser(r).ID {
+		http.Error(w, "Order user does not match the authenticated user", http.StatusForbidden)
+		return
+	}
+
+	if order.OrderID == "" {
+		http.Error(w, "Missing order_id", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Rolling back order %s", order.OrderID)
 
 	tx, err := db.Begin()
 	if err != nil {
@@ -225,23 +374,33 @@ func rollbackOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
-	for _, item := range order.Cart {
-		// Debugging: Print each item before processing
-		log.Printf("Processing rollback for item: %+v", item)
+	rows, err := tx.Query("DELETE FROM orders WHERE order_id = $1 AND user_id = $2 RETURNING user_id, product_id, quantity",
+		order.OrderID, order.UserID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to rollback order: %v", err)
+		http.Error(w, "Failed to rollback order", http.StatusInternalServerError)
+		return
+	}
 
-		_, err = tx.Exec("DELETE FROM orders WHERE user_id = $1 AND product_id = $2 AND email = $3",
-			order.UserID, item.ProductID, order.EmailID)
-		if err != nil {
+	var lines []CartItem
+	for rows.Next() {
+		var item CartItem
+		if err := rows.Scan(&item.UserID, &item.ProductID, &item.Quantity); err != nil {
+			rows.Close()
 			tx.Rollback()
-			log.Printf("Failed to rollback order: %v", err)
+			log.Printf("Failed to read rolled back order line: %v", err)
 			http.Error(w, "Failed to rollback order", http.StatusInternalServerError)
 			return
 		}
+		lines = append(lines, item)
+	}
+	rows.Close()
 
-		_, err = tx.Exec("INSERT INTO cart (user_id, product_id, quantity) VALUES ($1, $2, $3)",
-			order.UserID, item.ProductID, item.Quantity)
+	for _, item := range lines {
+		_, err = tx.Exec(`INSERT INTO cart (user_id, product_id, quantity) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, product_id) DO UPDATE SET quantity = cart.quantity + EXCLUDED.quantity`,
+			item.UserID, item.ProductID, item.Quantity)
 		if err != nil {
 			tx.Rollback()
 			log.Printf("Failed to add item back to cart: %v", err)
@@ -250,6 +409,14 @@ func rollbackOrder(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	_, err = tx.Exec("DELETE FROM order_headers WHERE id = $1 AND user_id = $2", order.OrderID, order.UserID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to delete order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to rollback order", http.StatusInternalServerError)
+		return
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		log.Printf("Failed to commit rollback transaction: %v", err)
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	_ "github.com/lib/pq"
+
+	"shared/auth"
+	"shared/idempotency"
+	"shared/messaging"
+)
+
+var db *sql.DB
+
+// uploadDir is where uploaded prescription scans are kept.
+var uploadDir = "./uploads"
+
+func main() {
+	var err error
+
+	err = godotenv.Load(".env")
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	err = InitDB()
+	if err != nil {
+		log.Fatalf("Error initializing database: %v", err)
+	}
+
+	err = auth.Init(db)
+	if err != nil {
+		log.Fatalf("Error initializing auth: %v", err)
+	}
+
+	err = idempotency.Init(db, "prescriptionservice")
+	if err != nil {
+		log.Fatalf("Error initializing idempotency store: %v", err)
+	}
+
+	err = initPrescriptions()
+	if err != nil {
+		log.Fatalf("Error initializing prescriptions: %v", err)
+	}
+
+	err = initReminders()
+	if err != nil {
+		log.Fatalf("Error initializing refill reminders: %v", err)
+	}
+	go sweepReminders()
+
+	http.Handle("/", http.FileServer(http.Dir("./static")))
+
+	http.HandleFunc("POST /prescriptions", auth.RequireAuth(uploadPrescription))
+	http.HandleFunc("GET /prescriptions", auth.RequireAuth(listPrescriptions))
+	http.HandleFunc("GET /prescriptions/{id}", auth.RequireAuth(getPrescription))
+	http.HandleFunc("GET /prescriptions/{id}/file", auth.RequireAuth(getPrescriptionFile))
+	http.HandleFunc("POST /prescriptions/{id}/approve", auth.RequireRole(approvePrescription, auth.RolePharmacist, auth.RoleAdmin))
+	http.HandleFunc("POST /prescriptions/{id}/reject", auth.RequireRole(rejectPrescription, auth.RolePharmacist, auth.RoleAdmin))
+
+	// Called by the orchestrator for each order.
+	http.HandleFunc("/prescriptions/check", auth.RequireService(checkPrescriptions, "orchestrator"))
+	http.HandleFunc("/prescriptions/fill", auth.RequireService(idempotency.Wrap(fillPrescriptions), "orchestrator"))
+	http.HandleFunc("/prescriptions/release", auth.RequireService(idempotency.Wrap(releasePrescriptions), "orchestrator"))
+
+	if url := os.Getenv("AMQP_URL"); url != "" {
+		broker, err := messaging.NewAMQPBroker(url)
+		if err != nil {
+			log.Fatalf("Error connecting to message broker: %v", err)
+		}
+		defer broker.Close()
+
+		err = messaging.Serve(broker, "prescription.requests", http.DefaultServeMux)
+		if err != nil {
+			log.Fatalf("Error consuming requests: %v", err)
+		}
+	}
+
+	fmt.Printf("Starting server at port 8008\n")
+	log.Fatal(http.ListenAndServe(":8008", nil))
+}
+
+func InitDB() error {
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("DB_HOST"),
+		os.Getenv("DB_PORT"),
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_PASSWORD"),
+		os.Getenv("DB_NAME"))
+
+	var err error
+	db, err = sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("error connecting to the database: %w", err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return fmt.Errorf("error pinging the database: %w", err)
+	}
+
+	log.Println("Successfully connected to the database")
+	return nil
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"shared/auth"
+)
+
+// Prescription statuses. A prescription is uploaded PENDING and reviewed
+// by a pharmacist; only APPROVED prescriptions can be filled.
+const (
+	statusPending  = "PENDING"
+	statusApproved = "APPROVED"
+	statusRejected = "REJECTED"
+)
+
+const maxUploadSize = 10 << 20
+
+// allowedTypes maps the accepted scan formats to their file extension.
+var allowedTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"application/pdf": ".pdf",
+}
+
+// A prescription allows refills+1 fills of up to quantity units of one
+// product until it expires. prescription_fills records which prescription
+// each order line used, so a failed order can hand its fill back. Fills
+// made before user_id was added are given the prescription's user.
+const prescriptionSchema = `
+ALTER TABLE products ADD COLUMN IF NOT EXISTS prescription_required BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE TABLE IF NOT EXISTS prescriptions (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	patient_name TEXT NOT NULL,
+	prescriber TEXT NOT NULL,
+	product_id INTEGER NOT NULL,
+	quantity INTEGER NOT NULL,
+	refills INTEGER NOT NULL,
+	fills_remaining INTEGER NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	file_name TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'PENDING',
+	reviewed_by INTEGER,
+	reviewed_at TIMESTAMP,
+	review_note TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS prescriptions_user_product_idx ON prescriptions (user_id, product_id);
+CREATE INDEX IF NOT EXISTS prescriptions_status_idx ON prescriptions (status);
+CREATE TABLE IF NOT EXISTS prescription_fills (
+	order_id TEXT NOT NULL,
+	product_id INTEGER NOT NULL,
+	prescription_id INTEGER NOT NULL REFERENCES prescriptions(id),
+	quantity INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (order_id, product_id)
+);
+ALTER TABLE prescription_fills ADD COLUMN IF NOT EXISTS user_id INTEGER;
+UPDATE prescription_fills f SET user_id = p.user_id FROM prescriptions p
+	WHERE f.prescription_id = p.id AND f.user_id IS NULL;`
+
+type Prescription struct {
+	ID             int        `json:"id"`
+	UserID         int        `json:"user_id"`
+	PatientName    string     `json:"patient_name"`
+	Prescriber     string     `json:"prescriber"`
+	ProductID      int        `json:"product_id"`
+	Quantity       int        `json:"quantity"`
+	Refills        int        `json:"refills"`
+	FillsRemaining int        `json:"fills_remaining"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	Status         string     `json:"status"`
+	ReviewedBy     *int       `json:"reviewed_by,omitempty"`
+	ReviewedAt     *time.Time `json:"reviewed_at,omitempty"`
+	ReviewNote     string     `json:"review_note,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+type CartItem struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+type Order struct {
+	OrderID string     `json:"order_id"`
+	UserID  int        `json:"user_id"`
+	Cart    []CartItem `json:"cart"`
+}
+
+const prescriptionColumns = `id, user_id, patient_name, prescriber, product_id, quantity, refills, fills_remaining,
+	expires_at, status, reviewed_by, reviewed_at, review_note, created_at`
+
+func initPrescriptions() error {
+	if dir := os.Getenv("PRESCRIPTION_DIR"); dir != "" {
+		uploadDir = dir
+	}
+
+	err := os.MkdirAll(uploadDir, 0o700)
+	if err != nil {
+		return fmt.Errorf("error creating upload directory: %w", err)
+	}
+
+	_, err = db.Exec(prescriptionSchema)
+	if err != nil {
+		return fmt.Errorf("error creating prescription tables: %w", err)
+	}
+	return nil
+}
+
+func scanPrescription(scan func(...any) error) (Prescription, error) {
+	var p Prescription
+	var reviewedBy sql.NullInt64
+	var reviewedAt sql.NullTime
+
+	err := scan(&p.ID, &p.UserID, &p.PatientName, &p.Prescriber, &p.ProductID, &p.Quantity, &p.Refills,
+		&p.FillsRemaining, &p.ExpiresAt, &p.Status, &reviewedBy, &reviewedAt, &p.ReviewNote, &p.CreatedAt)
+	if err != nil {
+		return p, err
+	}
+
+	if reviewedBy.Valid {
+		id := int(reviewedBy.Int64)
+		p.ReviewedBy = &id
+	}
+	if reviewedAt.Valid {
+		p.ReviewedAt = &reviewedAt.Time
+	}
+	return p, nil
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+// uploadPrescription stores a prescription uploaded as a multipart form
+// with the scan in its file field. It awaits review by a pharmacist.
+func uploadPrescription(w http.ResponseWriter, r *http.Request) {
+	log.Print("uploadPrescription invoked")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	err := r.ParseMultipartForm(maxUploadSize)
+	if err != nil {
+		http.Error(w, "Invalid upload, the form must be multipart and at most 10 MB", http.StatusBadRequest)
+		return
+	}
+
+	p := Prescription{
+		UserID:      auth.CurrentUser(r).ID,
+		PatientName: strings.TrimSpace(r.FormValue("patient_name")),
+		Prescriber:  strings.TrimSpace(r.FormValue("prescriber")),
+		Status:      statusPending,
+	}
+	p.ProductID, err = strconv.Atoi(r.FormValue("product_id"))
+	if err != nil {
+		http.Error(w, "Invalid product_id", http.StatusBadRequest)
+		return
+	}
+	p.Quantity, err = strconv.Atoi(r.FormValue("quantity"))
+	if err != nil || p.Quantity < 1 {
+		http.Error(w, "Invalid quantity", http.StatusBadRequest)
+		return
+	}
+	p.Refills, err = strconv.Atoi(r.FormValue("refills"))
+	if err != nil || p.Refills < 0 {
+		http.Error(w, "Invalid refills", http.StatusBadRequest)
+		return
+	}
+	p.FillsRemaining = p.Refills + 1
+	p.ExpiresAt, err = time.Parse("2006-01-02", r.FormValue("expires_at"))
+	if err != nil || !p.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expires_at must be a future date in YYYY-MM-DD format", http.StatusBadRequest)
+		return
+	}
+	if p.PatientName == "" || p.Prescriber == "" {
+		http.Error(w, "patient_name and prescriber are required", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)", p.ProductID).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Failed to store prescription", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "A scan of the prescription is required in the file field", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		http.Error(w, "Invalid upload", http.StatusBadRequest)
+		return
+	}
+	head = head[:n]
+
+	contentType := http.DetectContentType(head)
+	ext, ok := allowedTypes[contentType]
+	if !ok {
+		http.Error(w, "The scan must be a JPEG, PNG or PDF file", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	fileName, err := storeUpload(io.MultiReader(bytes.NewReader(head), file), ext)
+	if err != nil {
+		log.Printf("Failed to store prescription scan: %v", err)
+		http.Error(w, "Failed to store prescription", http.StatusInternalServerError)
+		return
+	}
+
+	row := db.QueryRow(`INSERT INTO prescriptions (user_id, patient_name, prescriber, product_id, quantity, refills,
+			fills_remaining, expires_at, file_name, content_type)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING `+prescriptionColumns,
+		p.UserID, p.PatientName, p.Prescriber, p.ProductID, p.Quantity, p.Refills, p.FillsRemaining, p.ExpiresAt,
+		fileName, contentType)
+	p, err = scanPrescription(row.Scan)
+	if err != nil {
+		os.Remove(filepath.Join(uploadDir, fileName))
+		log.Printf("Failed to store prescription: %v", err)
+		http.Error(w, "Failed to store prescription", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d uploaded prescription %d for product %d", p.UserID, p.ID, p.ProductID)
+	writeJSON(w, http.StatusCreated, p)
+}
+
+// storeUpload writes an upload to a new file with a random name and returns
+// that name.
+func storeUpload(src io.Reader, ext string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	fileName := hex.EncodeToString(b) + ext
+
+	f, err := os.OpenFile(filepath.Join(uploadDir, fileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return fileName, nil
+}
+
+// listPrescriptions returns the user's prescriptions, newest first.
+// Pharmacists and admins see everyone's and may filter by status, e.g. to
+// find those awaiting review.
+func listPrescriptions(w http.ResponseWriter, r *http.Request) {
+	log.Print("listPrescriptions invoked")
+
+	user := auth.CurrentUser(r)
+
+	var conditions []string
+	var args []any
+	if !user.HasRole(auth.RolePharmacist, auth.RoleAdmin) {
+		args = append(args, user.ID)
+		conditions = append(conditions, fmt.Sprintf("user_id = $%d", len(args)))
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		args = append(args, strings.ToUpper(status))
+		conditions = append(conditions, fmt.Sprintf("status = $%d", len(args)))
+	}
+
+	query := "SELECT " + prescriptionColumns + " FROM prescriptions"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error listing prescriptions: %v", err)
+		http.Error(w, "Error fetching prescriptions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	prescriptions := []Prescription{}
+	for rows.Next() {
+		p, err := scanPrescription(rows.Scan)
+		if err != nil {
+			log.Printf("Error scanning prescription: %v", err)
+			http.Error(w, "Error fetching prescriptions", http.StatusInternalServerError)
+			return
+		}
+		prescriptions = append(prescriptions, p)
+	}
+
+	writeJSON(w, http.StatusOK, prescriptions)
+}
+
+// loadPrescription returns the prescription in the request path if the
+// user may see it: their own, or any if they are staff. Otherwise it
+// answers the request itself and returns false.
+func loadPrescription(w http.ResponseWriter, r *http.Request) (Prescription, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid prescription ID", http.StatusBadRequest)
+		return Prescription{}, false
+	}
+
+	row := db.QueryRow("SELECT "+prescriptionColumns+" FROM prescriptions WHERE id = $1", id)
+	p, err := scanPrescription(row.Scan)
+	user := auth.CurrentUser(r)
+	if err == sql.ErrNoRows || (err == nil && p.UserID != user.ID && !user.HasRole(auth.RolePharmacist, auth.RoleAdmin)) {
+		http.Error(w, "Prescription not found", http.StatusNotFound)
+		return Prescription{}, false
+	}
+	if err != nil {
+		log.Printf("Error loading prescription %d: %v", id, err)
+		http.Error(w, "Error fetching prescription", http.StatusInternalServerError)
+		return Prescription{}, false
+	}
+	return p, true
+}
+
+func getPrescription(w http.ResponseWriter, r *http.Request) {
+	log.Print("getPrescription invoked")
+
+	p, ok := loadPrescription(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func getPrescriptionFile(w http.ResponseWriter, r *http.Request) {
+	log.Print("getPrescriptionFile invoked")
+
+	p, ok := loadPrescription(w, r)
+	if !ok {
+		return
+	}
+
+	var fileName, contentType string
+	err := db.QueryRow("SELECT file_name, content_type FROM prescriptions WHERE id = $1", p.ID).Scan(&fileName, &contentType)
+	if err != nil {
+		http.Error(w, "Error fetching prescription", http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(uploadDir, fileName))
+	if err != nil {
+		log.Printf("Error opening scan of prescription %d: %v", p.ID, err)
+		http.Error(w, "Prescription scan not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, fileName, p.CreatedAt, f)
+}
+
+func approvePrescription(w http.ResponseWriter, r *http.Request) {
+	reviewPrescription(w, r, statusApproved)
+}
+
+func rejectPrescription(w http.ResponseWriter, r *http.Request) {
+	reviewPrescription(w, r, statusRejected)
+}
+
+// reviewPrescription records a pharmacist's decision on a pending
+// prescription, with an optional note for the customer. Orders waiting for
+// the prescription pick the decision up on their next check.
+func reviewPrescription(w http.ResponseWriter, r *http.Request, status string) {
+	log.Printf("reviewPrescription invoked: %s", status)
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid prescription ID", http.StatusBadRequest)
+		return
+	}
+
+	var review struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	reviewer := auth.CurrentUser(r)
+	row := db.QueryRow(`UPDATE prescriptions SET status = $1, reviewed_by = $2, reviewed_at = NOW(), review_note = $3
+		WHERE id = $4 AND status = $5 RETURNING `+prescriptionColumns,
+		status, reviewer.ID, strings.TrimSpace(review.Note), id, statusPending)
+	p, err := scanPrescription(row.Scan)
+	if err == sql.ErrNoRows {
+		var exists bool
+		db.QueryRow("SELECT EXISTS (SELECT 1 FROM prescriptions WHERE id = $1)", id).Scan(&exists)
+		if !exists {
+			http.Error(w, "Prescription not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Prescription was already reviewed", http.StatusConflict)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to review prescription %d: %v", id, err)
+		http.Error(w, "Failed to review prescription", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Prescription %d %s by user %d", id, strings.ToLower(status), reviewer.ID)
+	writeJSON(w, http.StatusOK, p)
+}
+
+// decodeOrder reads an order sent by the orchestrator on behalf of its
+// user.
+func decodeOrder(w http.ResponseWriter, r *http.Request) (Order, bool) {
+	var order Order
+	err := json.NewDecoder(r.Body).Decode(&order)
+	if err != nil || order.OrderID == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return order, false
+	}
+
+	if order.UserID != auth.CurrentUser(r).ID {
+		http.Error(w, "Order user does not match the authenticated user", http.StatusForbidden)
+		return order, false
+	}
+	return order, true
+}
+
+// prescriptionLines returns the order's lines for prescription-only
+// products, with the quantities of repeated products added up.
+func prescriptionLines(order Order) ([]CartItem, error) {
+	quantities := make(map[int]int)
+	var productIDs []int64
+	for _, item := range order.Cart {
+		if _, ok := quantities[item.ProductID]; !ok {
+			productIDs = append(productIDs, int64(item.ProductID))
+		}
+		quantities[item.ProductID] += item.Quantity
+	}
+
+	rows, err := db.Query("SELECT id FROM products WHERE id = ANY($1) AND prescription_required ORDER BY id",
+		pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []CartItem
+	for rows.Next() {
+		var productID int
+		if err := rows.Scan(&productID); err != nil {
+			return nil, err
+		}
+		lines = append(lines, CartItem{ProductID: productID, Quantity: quantities[productID]})
+	}
+	return lines, rows.Err()
+}
+
+type queryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// findPrescription returns the ID and status of the user's prescription
+// that should fill an order line, preferring approved ones and those
+// expiring first.
+func findPrescription(q queryer, userID int, line CartItem, statuses []string, lock bool) (int, string, error) {
+	query := `SELECT id, status FROM prescriptions
+		WHERE user_id = $1 AND product_id = $2 AND quantity >= $3 AND fills_remaining > 0
+		AND expires_at > NOW() AND status = ANY($4)
+		ORDER BY status = 'APPROVED' DESC, expires_at, id LIMIT 1`
+	if lock {
+		query += " FOR UPDATE"
+	}
+
+	var id int
+	var status string
+	err := q.QueryRow(query, userID, line.ProductID, line.Quantity, pq.Array(statuses)).Scan(&id, &status)
+	return id, status, err
+}
+
+func isFilled(q queryer, userID int, orderID string, productID int) (bool, error) {
+	var filled bool
+	err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM prescription_fills WHERE user_id = $1 AND order_id = $2 AND product_id = $3)",
+		userID, orderID, productID).Scan(&filled)
+	return filled, err
+}
+
+// checkPrescriptions tells the orchestrator whether an order can be filled:
+// 200 if every prescription-only line has an approved prescription, 202 if
+// some are still awaiting review, and 422 if a line has no usable
+// prescription at all. It changes nothing, so it is not idempotent-wrapped;
+// a replayed 202 would keep the order waiting forever.
+func checkPrescriptions(w http.ResponseWriter, r *http.Request) {
+	log.Print("checkPrescriptions invoked")
+
+	order, ok := decodeOrder(w, r)
+	if !ok {
+		return
+	}
+
+	lines, err := prescriptionLines(order)
+	if err != nil {
+		log.Printf("Error reading prescription lines of order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to check prescriptions", http.StatusInternalServerError)
+		return
+	}
+
+	pending := []int{}
+	for _, line := range lines {
+		filled, err := isFilled(db, order.UserID, order.OrderID, line.ProductID)
+		if err != nil {
+			http.Error(w, "Failed to check prescriptions", http.StatusInternalServerError)
+			return
+		}
+		if filled {
+			continue
+		}
+
+		id, status, err := findPrescription(db, order.UserID, line, []string{statusApproved, statusPending}, false)
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
+				"message": fmt.Sprintf("No valid prescription for %d units of product ID %d", line.Quantity, line.ProductID),
+			})
+			return
+		}
+		if err != nil {
+			log.Printf("Error finding prescription for order %s: %v", order.OrderID, err)
+			http.Error(w, "Failed to check prescriptions", http.StatusInternalServerError)
+			return
+		}
+		if status == statusPending {
+			pending = append(pending, id)
+		}
+	}
+
+	if len(pending) > 0 {
+		writeJSON(w, http.StatusAccepted, map[string]any{
+			"message":          "Awaiting pharmacist approval",
+			"prescription_ids": pending,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Prescriptions approved"})
+}
+
+// fillPrescriptions uses up one fill of an approved prescription for each
+// prescription-only line of the order.
+func fillPrescriptions(w http.ResponseWriter, r *http.Request) {
+	log.Print("fillPrescriptions invoked")
+
+	order, ok := decodeOrder(w, r)
+	if !ok {
+		return
+	}
+
+	lines, err := prescriptionLines(order)
+	if err != nil {
+		log.Printf("Error reading prescription lines of order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to fill prescriptions", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, line := range lines {
+		filled, err := isFilled(tx, order.UserID, order.OrderID, line.ProductID)
+		if err != nil {
+			http.Error(w, "Failed to fill prescriptions", http.StatusInternalServerError)
+			return
+		}
+		if filled {
+			continue
+		}
+
+		id, _, err := findPrescription(tx, order.UserID, line, []string{statusApproved}, true)
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("No approved prescription for product ID %d", line.ProductID), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error finding prescription for order %s: %v", order.OrderID, err)
+			http.Error(w, "Failed to fill prescriptions", http.StatusInternalServerError)
+			return
+		}
+
+		_, err = tx.Exec("UPDATE prescriptions SET fills_remaining = fills_remaining - 1 WHERE id = $1", id)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO prescription_fills (order_id, user_id, product_id, prescription_id, quantity)
+				VALUES ($1, $2, $3, $4, $5)`,
+				order.OrderID, order.UserID, line.ProductID, id, line.Quantity)
+		}
+		if err != nil {
+			log.Printf("Failed to fill prescription %d for order %s: %v", id, order.OrderID, err)
+			http.Error(w, "Failed to fill prescriptions", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Filled prescription %d for order %s", id, order.OrderID)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Prescriptions filled"})
+}
+
+// releasePrescriptions hands the fills used by an order back to their
+// prescriptions. Only the orchestrator calls it, when it compensates a
+// failed order.
+func releasePrescriptions(w http.ResponseWriter, r *http.Request) {
+	log.Print("releasePrescriptions invoked")
+
+	order, ok := decodeOrder(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("DELETE FROM prescription_fills WHERE order_id = $1 AND user_id = $2 RETURNING prescription_id",
+		order.OrderID, order.UserID)
+	if err != nil {
+		log.Printf("Failed to release prescriptions of order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to release prescriptions", http.StatusInternalServerError)
+		return
+	}
+
+	var released []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, "Failed to release prescriptions", http.StatusInternalServerError)
+			return
+		}
+		released = append(released, id)
+	}
+	rows.Close()
+
+	for _, id := range released {
+		_, err = tx.Exec("UPDATE prescriptions SET fills_remaining = fills_remaining + 1 WHERE id = $1", id)
+		if err != nil {
+			log.Printf("Failed to restore fill of prescription %d: %v", id, err)
+			http.Error(w, "Failed to release prescriptions", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Released %d prescription fills of order %s", len(released), order.OrderID)
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Prescriptions released"})
+}
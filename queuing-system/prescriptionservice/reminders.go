@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"shared/auth"
+)
+
+// An approved prescription with fills left is reminded about once, when it
+// is within reminderWindow of expiring. reminder_attempts counts the tries,
+// so a reminder that failed is sent under a new idempotency key.
+const reminderSchema = `
+ALTER TABLE prescriptions ADD COLUMN IF NOT EXISTS reminded_at TIMESTAMP;
+ALTER TABLE prescriptions ADD COLUMN IF NOT EXISTS reminder_attempts INTEGER NOT NULL DEFAULT 0;`
+
+const (
+	reminderWindow   = 14 * 24 * time.Hour
+	reminderInterval = time.Hour
+)
+
+// notificationURL is where refill reminders are sent.
+var notificationURL = "http://localhost:8004"
+
+// RefillReminder is sent to notificationservice for each prescription that
+// is about to expire with fills left.
+type RefillReminder struct {
+	UserID         int       `json:"user_id"`
+	EmailID        string    `json:"email_id"`
+	PrescriptionID int       `json:"prescription_id"`
+	ProductID      int       `json:"product_id"`
+	ProductName    string    `json:"product_name"`
+	FillsRemaining int       `json:"fills_remaining"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+func initReminders() error {
+	if url := os.Getenv("NOTIFICATION_URL"); url != "" {
+		notificationURL = strings.TrimRight(url, "/")
+	}
+
+	_, err := db.Exec(reminderSchema)
+	if err != nil {
+		return fmt.Errorf("error creating reminder columns: %w", err)
+	}
+	return nil
+}
+
+func sweepReminders() {
+	for range time.Tick(reminderInterval) {
+		sendReminders()
+	}
+}
+
+// sendReminders sends the reminders that are due. Each prescription is
+// claimed by setting reminded_at before it is sent, so two instances never
+// remind about the same one, and released again if sending fails.
+func sendReminders() {
+	rows, err := db.Query(`UPDATE prescriptions p SET reminded_at = NOW()
+		FROM users u, products pr
+		WHERE p.id IN (
+			SELECT id FROM prescriptions
+			WHERE status = $1 AND fills_remaining > 0 AND reminded_at IS NULL
+			AND expires_at > NOW() AND expires_at <= NOW() + make_interval(secs => $2)
+			FOR UPDATE SKIP LOCKED
+		) AND u.id = p.user_id AND pr.id = p.product_id
+		RETURNING p.id, p.user_id, u.email, p.product_id, pr.name, p.fills_remaining, p.expires_at, p.reminder_attempts`,
+		statusApproved, reminderWindow.Seconds())
+	if err != nil {
+		log.Printf("Error claiming refill reminders: %v", err)
+		return
+	}
+
+	var reminders []RefillReminder
+	var attempts []int
+	for rows.Next() {
+		var reminder RefillReminder
+		var attempt int
+		err := rows.Scan(&reminder.PrescriptionID, &reminder.UserID, &reminder.EmailID, &reminder.ProductID,
+			&reminder.ProductName, &reminder.FillsRemaining, &reminder.ExpiresAt, &attempt)
+		if err != nil {
+			log.Printf("Error scanning refill reminder: %v", err)
+			continue
+		}
+		reminders = append(reminders, reminder)
+		attempts = append(attempts, attempt)
+	}
+	rows.Close()
+
+	for i, reminder := range reminders {
+		err := sendReminder(reminder, attempts[i])
+		if err == nil {
+			log.Printf("Sent refill reminder for prescription %d", reminder.PrescriptionID)
+			continue
+		}
+
+		log.Printf("Failed to send refill reminder for prescription %d: %v", reminder.PrescriptionID, err)
+		_, err = db.Exec("UPDATE prescriptions SET reminded_at = NULL, reminder_attempts = reminder_attempts + 1 WHERE id = $1",
+			reminder.PrescriptionID)
+		if err != nil {
+			log.Printf("Failed to release refill reminder for prescription %d: %v", reminder.PrescriptionID, err)
+		}
+	}
+}
+
+func sendReminder(reminder RefillReminder, attempt int) error {
+	body, err := json.Marshal(reminder)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, notificationURL+"/refill-reminder", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	token, err := auth.ServiceToken("prescriptionservice", reminder.UserID)
+	if err != nil {
+		return fmt.Errorf("error issuing service token: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", fmt.Sprintf("refill-%d-%d", reminder.PrescriptionID, attempt))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("notification service responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
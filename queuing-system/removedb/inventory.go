@@ -0,0 +1,327 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/lib/pq"
+
+	"shared/auth"
+	"shared/stock"
+)
+
+// The inventory API is the only place stock is checked and taken for an
+// order. The saga calls each endpoint once per order:
+//
+//   - allocate holds the order's stock, taking over the customer's cart
+//     reservations, or fails if there is not enough,
+//   - commit removes the allocated stock from its lots, first expiring
+//     first out,
+//   - release gives back whatever the order holds, allocated or committed.
+//
+// Each runs in one transaction that locks the order's product rows, in ID
+// order, so concurrent orders for the same products are serialised across
+// every instance of this service.
+
+// quantities sums the quantities of the order's lines by product.
+func (order Order) quantities() map[int]int {
+	quantities := make(map[int]int)
+	for _, item := range order.Cart {
+		quantities[item.ProductID] += item.Quantity
+	}
+	return quantities
+}
+
+func (order Order) productIDs() []int {
+	var productIDs []int
+	for id := range order.quantities() {
+		productIDs = append(productIDs, id)
+	}
+	return productIDs
+}
+
+// lockProducts locks the product rows in ID order and returns the IDs.
+func lockProducts(tx *sql.Tx, productIDs []int) ([]int, error) {
+	sort.Ints(productIDs)
+	ids := make([]int64, len(productIDs))
+	for i, id := range productIDs {
+		ids[i] = int64(id)
+	}
+
+	rows, err := tx.Query("SELECT id FROM products WHERE id = ANY($1) ORDER BY id FOR UPDATE", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locked []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		locked = append(locked, id)
+	}
+	return locked, rows.Err()
+}
+
+// heldProductIDs returns the products the order holds stock of, allocated
+// or committed.
+func heldProductIDs(tx *sql.Tx, orderID string) ([]int, error) {
+	rows, err := tx.Query(`SELECT product_id FROM stock_reservations WHERE order_id = $1
+		UNION SELECT product_id FROM order_line_lots WHERE order_id = $1`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var productIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		productIDs = append(productIDs, id)
+	}
+	return productIDs, rows.Err()
+}
+
+// decodeInventoryOrder reads the order of an inventory request, checking
+// that it belongs to the caller.
+func decodeInventoryOrder(w http.ResponseWriter, r *http.Request) (Order, bool) {
+	var order Order
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return order, false
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&order)
+	if err != nil || order.OrderID == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return order, false
+	}
+
+	if order.UserID != auth.CurrentUser(r).ID {
+		http.Error(w, "Order user does not match the authenticated user", http.StatusForbidden)
+		return order, false
+	}
+	return order, true
+}
+
+func allocateInventory(w http.ResponseWriter, r *http.Request) {
+	log.Print("allocateInventory invoked")
+
+	order, ok := decodeInventoryOrder(w, r)
+	if !ok {
+		return
+	}
+
+	for _, item := range order.Cart {
+		if item.Quantity < 1 {
+			http.Error(w, fmt.Sprintf("Invalid quantity for product ID %d", item.ProductID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	quantities := order.quantities()
+	productIDs := order.productIDs()
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	locked, err := lockProducts(tx, productIDs)
+	if err != nil {
+		log.Printf("Failed to lock products of order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to allocate stock", http.StatusInternalServerError)
+		return
+	}
+	if len(locked) != len(productIDs) {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	for _, productID := range locked {
+		quantity := quantities[productID]
+
+		available, err := stock.AvailableToPromise(tx, productID, order.UserID)
+		if err != nil {
+			log.Printf("Failed to fetch available stock of product %d: %v", productID, err)
+			http.Error(w, "Failed to allocate stock", http.StatusInternalServerError)
+			return
+		}
+		if available < quantity {
+			http.Error(w, fmt.Sprintf("Insufficient quantity for product ID %d", productID), http.StatusConflict)
+			return
+		}
+
+		// The customer's cart reservation is replaced by the allocation.
+		_, err = tx.Exec("DELETE FROM stock_reservations WHERE user_id = $1 AND product_id = $2 AND order_id IS NULL",
+			order.UserID, productID)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO stock_reservations (user_id, product_id, quantity, order_id) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (order_id, product_id) WHERE order_id IS NOT NULL DO UPDATE SET quantity = EXCLUDED.quantity`,
+				order.UserID, productID, quantity, order.OrderID)
+		}
+		if err != nil {
+			log.Printf("Failed to allocate product %d to order %s: %v", productID, order.OrderID, err)
+			http.Error(w, "Failed to allocate stock", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Allocated stock to order %s", order.OrderID)
+	response := map[string]string{"message": "Stock allocated"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func commitInventory(w http.ResponseWriter, r *http.Request) {
+	log.Print("commitInventory invoked")
+
+	order, ok := decodeInventoryOrder(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// The allocation, not the order sent, says what is taken.
+	allocated := make(map[int]int)
+	var productIDs []int
+	rows, err := tx.Query("SELECT product_id, quantity FROM stock_reservations WHERE order_id = $1", order.OrderID)
+	if err == nil {
+		for rows.Next() {
+			var productID, quantity int
+			if err = rows.Scan(&productID, &quantity); err != nil {
+				break
+			}
+			allocated[productID] = quantity
+			productIDs = append(productIDs, productID)
+		}
+		rows.Close()
+	}
+	if err != nil {
+		log.Printf("Failed to load allocation of order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to update product stock", http.StatusInternalServerError)
+		return
+	}
+	if len(productIDs) == 0 {
+		var committed bool
+		err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM order_line_lots WHERE order_id = $1)", order.OrderID).Scan(&committed)
+		if err != nil || !committed {
+			http.Error(w, "No stock is allocated to this order", http.StatusConflict)
+			return
+		}
+		log.Printf("Stock for order %s was already removed", order.OrderID)
+		response := map[string]string{"message": "Items successfully removed from db"}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	locked, err := lockProducts(tx, productIDs)
+	if err != nil {
+		log.Printf("Failed to lock products of order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to update product stock", http.StatusInternalServerError)
+		return
+	}
+
+	for _, productID := range locked {
+		err = allocateLots(tx, order.OrderID, productID, allocated[productID])
+		if err == errInsufficientStock {
+			http.Error(w, fmt.Sprintf("Insufficient unexpired stock for product ID %d", productID), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to update product stock: %v", err)
+			http.Error(w, "Failed to update product stock", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = releaseAllocation(tx, order.OrderID)
+	if err != nil {
+		log.Printf("Failed to release allocation of order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to update product stock", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("Failed to commit transaction: %v", err)
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Removed stock for order %s", order.OrderID)
+	response := map[string]string{"message": "Items successfully removed from db"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// releaseInventory gives back the stock of an order: its allocation if the
+// stock has not been removed yet, otherwise the lots it was taken from.
+// Releasing an order that holds nothing does nothing.
+func releaseInventory(w http.ResponseWriter, r *http.Request) {
+	log.Print("releaseInventory invoked")
+
+	order, ok := decodeInventoryOrder(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// What the order holds is read back rather than taken from the
+	// request, so that every product whose stock is given back is locked.
+	productIDs, err := heldProductIDs(tx, order.OrderID)
+	if err == nil {
+		_, err = lockProducts(tx, productIDs)
+	}
+	if err == nil {
+		err = releaseAllocation(tx, order.OrderID)
+	}
+	if err == nil {
+		err = releaseLots(tx, order.OrderID)
+	}
+	if err != nil {
+		log.Printf("Failed to restore stock of order %s: %v", order.OrderID, err)
+		http.Error(w, "Failed to rollback product stock", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, "Failed to commit rollback transaction", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Released stock of order %s", order.OrderID)
+	response := map[string]string{"message": "Product stock successfully restored"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
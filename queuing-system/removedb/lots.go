@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Stock is held in lots, created by the shared stock package, each a batch
+// of a product with its own expiry date. A recalled lot is quarantined and
+// never sold again. products.quantity is kept equal to the sum over the
+// product's lots that are not quarantined. order_line_lots records which
+// lots each order line was taken from, for recalls and audits.
+//
+// The UNTRACKED lot stock booked in before lots were tracked is moved to
+// has no expiry date, so it is sold after every dated lot.
+const lotSchema = `
+CREATE TABLE IF NOT EXISTS order_line_lots (
+	order_id TEXT NOT NULL,
+	product_id INTEGER NOT NULL,
+	lot_id INTEGER NOT NULL REFERENCES product_lots(id),
+	quantity INTEGER NOT NULL,
+	PRIMARY KEY (order_id, product_id, lot_id)
+);
+CREATE INDEX IF NOT EXISTS order_line_lots_lot_id_idx ON order_line_lots (lot_id);
+ALTER TABLE stock_adjustments ADD COLUMN IF NOT EXISTS lot_id INTEGER REFERENCES product_lots(id);`
+
+type Lot struct {
+	ID          int        `json:"id"`
+	ProductID   int        `json:"product_id"`
+	BatchNumber string     `json:"batch_number"`
+	ExpiryDate  *time.Time `json:"expiry_date,omitempty"`
+	Quantity    int        `json:"quantity"`
+	ReceivedAt  time.Time  `json:"received_at"`
+	Expired     bool       `json:"expired"`
+	Quarantined bool       `json:"quarantined"`
+}
+
+// errInsufficientStock is returned when a product has too few unexpired
+// units to fill an order line.
+var errInsufficientStock = errors.New("insufficient unexpired stock")
+
+func initLots() error {
+	_, err := db.Exec(lotSchema)
+	if err != nil {
+		return fmt.Errorf("error creating lot tables: %w", err)
+	}
+	return nil
+}
+
+// allocateLots takes quantity units of a product for an order line, first
+// expiring first out. Expired lots are never sold.
+func allocateLots(tx *sql.Tx, orderID string, productID, quantity int) error {
+	rows, err := tx.Query(`SELECT id, quantity FROM product_lots
+		WHERE product_id = $1 AND quantity > 0 AND NOT quarantined
+			AND (expiry_date IS NULL OR expiry_date >= CURRENT_DATE)
+		ORDER BY expiry_date NULLS LAST, id
+		FOR UPDATE`, productID)
+	if err != nil {
+		return err
+	}
+
+	type take struct{ lotID, quantity int }
+	var takes []take
+	remaining := quantity
+	for rows.Next() && remaining > 0 {
+		var lotID, available int
+		if err := rows.Scan(&lotID, &available); err != nil {
+			rows.Close()
+			return err
+		}
+		n := min(available, remaining)
+		takes = append(takes, take{lotID, n})
+		remaining -= n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return errInsufficientStock
+	}
+
+	for _, t := range takes {
+		_, err = tx.Exec("UPDATE product_lots SET quantity = quantity - $1 WHERE id = $2", t.quantity, t.lotID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO order_line_lots (order_id, product_id, lot_id, quantity) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (order_id, product_id, lot_id) DO UPDATE SET quantity = order_line_lots.quantity + EXCLUDED.quantity`,
+			orderID, productID, t.lotID, t.quantity)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE products SET quantity = quantity - $1 WHERE id = $2", quantity, productID)
+	return err
+}
+
+// releaseLots puts the stock an order took back into the lots it was taken
+// from. An order that took none is left alone.
+func releaseLots(tx *sql.Tx, orderID string) error {
+	rows, err := tx.Query(`WITH released AS (
+			DELETE FROM order_line_lots WHERE order_id = $1 RETURNING product_id, lot_id, quantity
+		), restored AS (
+			UPDATE product_lots l SET quantity = l.quantity + r.quantity
+			FROM (SELECT lot_id, SUM(quantity) AS quantity FROM released GROUP BY lot_id) r
+			WHERE l.id = r.lot_id
+		)
+		SELECT DISTINCT product_id FROM released`, orderID)
+	if err != nil {
+		return err
+	}
+
+	var productIDs []int64
+	for rows.Next() {
+		var productID int64
+		if err := rows.Scan(&productID); err != nil {
+			rows.Close()
+			return err
+		}
+		productIDs = append(productIDs, productID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(productIDs) == 0 {
+		return nil
+	}
+	return syncProductQuantity(tx, productIDs)
+}
+
+// syncProductQuantity sets the stock of the products to the sum of their
+// lots that may be sold. Stock put back into a quarantined lot is not.
+func syncProductQuantity(tx *sql.Tx, productIDs []int64) error {
+	_, err := tx.Exec(`UPDATE products p SET quantity = (
+			SELECT COALESCE(SUM(l.quantity), 0) FROM product_lots l WHERE l.product_id = p.id AND NOT l.quarantined
+		) WHERE p.id = ANY($1)`, pq.Array(productIDs))
+	return err
+}
+
+// listLots returns the lots of a product, soonest expiry first.
+func listLots(w http.ResponseWriter, r *http.Request) {
+	log.Print("listLots invoked")
+
+	productID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, product_id, batch_number, expiry_date, quantity, received_at,
+		COALESCE(expiry_date < CURRENT_DATE, FALSE), quarantined
+		FROM product_lots WHERE product_id = $1 ORDER BY expiry_date NULLS LAST, id`, productID)
+	if err != nil {
+		log.Printf("Error loading lots of product %d: %v", productID, err)
+		http.Error(w, "Error fetching lots", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	lots := []Lot{}
+	for rows.Next() {
+		var lot Lot
+		var expiry sql.NullTime
+		err := rows.Scan(&lot.ID, &lot.ProductID, &lot.BatchNumber, &expiry, &lot.Quantity, &lot.ReceivedAt, &lot.Expired,
+			&lot.Quarantined)
+		if err != nil {
+			log.Printf("Error scanning lot: %v", err)
+			http.Error(w, "Error fetching lots", http.StatusInternalServerError)
+			return
+		}
+		if expiry.Valid {
+			lot.ExpiryDate = &expiry.Time
+		}
+		lots = append(lots, lot)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lots)
+}
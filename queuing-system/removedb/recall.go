@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"shared/auth"
+)
+
+// A recall quarantines lots of a product and notifies every customer whose
+// order was filled from them. recall_notices tracks the notice sent for
+// each affected order, so failed notices can be sent again.
+const recallSchema = `
+CREATE TABLE IF NOT EXISTS recalls (
+	id SERIAL PRIMARY KEY,
+	product_id INTEGER NOT NULL,
+	batch_numbers TEXT[] NOT NULL,
+	reason TEXT NOT NULL,
+	created_by INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS recall_notices (
+	recall_id INTEGER NOT NULL REFERENCES recalls(id),
+	order_id TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	email TEXT NOT NULL,
+	quantity INTEGER NOT NULL,
+	batch_numbers TEXT[] NOT NULL,
+	status TEXT NOT NULL DEFAULT 'PENDING',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	sent_at TIMESTAMP,
+	PRIMARY KEY (recall_id, order_id)
+);`
+
+const (
+	noticePending = "PENDING"
+	noticeSent    = "SENT"
+	noticeFailed  = "FAILED"
+)
+
+type Recall struct {
+	ID           int       `json:"id"`
+	ProductID    int       `json:"product_id"`
+	BatchNumbers []string  `json:"batch_numbers"`
+	Reason       string    `json:"reason"`
+	CreatedBy    int       `json:"created_by"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	Quarantined int            `json:"quarantined"`
+	Notices     map[string]int `json:"notices"`
+}
+
+// RecallNotice is sent to notificationservice for each affected order.
+type RecallNotice struct {
+	RecallID     int      `json:"recall_id"`
+	OrderID      string   `json:"order_id"`
+	UserID       int      `json:"user_id"`
+	EmailID      string   `json:"email_id"`
+	ProductID    int      `json:"product_id"`
+	ProductName  string   `json:"product_name"`
+	BatchNumbers []string `json:"batch_numbers"`
+	Quantity     int      `json:"quantity"`
+	Reason       string   `json:"reason"`
+}
+
+// notificationURL is where recall notices are sent.
+var notificationURL = "http://localhost:8004"
+
+func initRecalls() error {
+	if url := os.Getenv("NOTIFICATION_URL"); url != "" {
+		notificationURL = strings.TrimRight(url, "/")
+	}
+
+	_, err := db.Exec(recallSchema)
+	if err != nil {
+		return fmt.Errorf("error creating recall tables: %w", err)
+	}
+	return nil
+}
+
+// createRecall quarantines the given lots of a product, records a notice
+// for every order filled from them and starts sending the notices.
+func createRecall(w http.ResponseWriter, r *http.Request) {
+	log.Print("createRecall invoked")
+
+	var recall Recall
+	err := json.NewDecoder(r.Body).Decode(&recall)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	recall.Reason = strings.TrimSpace(recall.Reason)
+	var batches []string
+	seen := make(map[string]bool)
+	for _, batch := range recall.BatchNumbers {
+		if batch = strings.TrimSpace(batch); batch != "" && !seen[batch] {
+			seen[batch] = true
+			batches = append(batches, batch)
+		}
+	}
+	recall.BatchNumbers = batches
+	if recall.ProductID == 0 || len(recall.BatchNumbers) == 0 || recall.Reason == "" {
+		http.Error(w, "product_id, batch_numbers and a reason are required", http.StatusBadRequest)
+		return
+	}
+
+	recall.CreatedBy = auth.CurrentUser(r).ID
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = lockProducts(tx, []int{recall.ProductID})
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to lock product %d: %v", recall.ProductID, err)
+		http.Error(w, "Failed to create recall", http.StatusInternalServerError)
+		return
+	}
+
+	var found []string
+	rows, err := tx.Query(`SELECT batch_number FROM product_lots WHERE product_id = $1 AND batch_number = ANY($2)
+		FOR UPDATE`, recall.ProductID, pq.Array(recall.BatchNumbers))
+	if err == nil {
+		for rows.Next() {
+			var batch string
+			if err = rows.Scan(&batch); err != nil {
+				break
+			}
+			found = append(found, batch)
+		}
+		rows.Close()
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to load lots of product %d: %v", recall.ProductID, err)
+		http.Error(w, "Failed to create recall", http.StatusInternalServerError)
+		return
+	}
+	if len(found) != len(recall.BatchNumbers) {
+		tx.Rollback()
+		http.Error(w, fmt.Sprintf("Unknown batch numbers for product ID %d; known: %s",
+			recall.ProductID, strings.Join(found, ", ")), http.StatusNotFound)
+		return
+	}
+
+	err = tx.QueryRow("INSERT INTO recalls (product_id, batch_numbers, reason, created_by) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		recall.ProductID, pq.Array(recall.BatchNumbers), recall.Reason, recall.CreatedBy).Scan(&recall.ID, &recall.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to record recall: %v", err)
+		http.Error(w, "Failed to create recall", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.QueryRow(`WITH quarantined AS (
+			UPDATE product_lots SET quarantined = TRUE
+			WHERE product_id = $1 AND batch_number = ANY($2) AND NOT quarantined
+			RETURNING quantity
+		) SELECT COALESCE(SUM(quantity), 0) FROM quarantined`,
+		recall.ProductID, pq.Array(recall.BatchNumbers)).Scan(&recall.Quarantined)
+	if err == nil {
+		err = syncProductQuantity(tx, []int64{int64(recall.ProductID)})
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to quarantine lots of product %d: %v", recall.ProductID, err)
+		http.Error(w, "Failed to create recall", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := tx.Exec(`INSERT INTO recall_notices (recall_id, order_id, user_id, email, quantity, batch_numbers)
+		SELECT $1, h.id, h.user_id, h.email, SUM(ol.quantity), ARRAY_AGG(DISTINCT l.batch_number ORDER BY l.batch_number)
+		FROM order_line_lots ol
+		JOIN product_lots l ON l.id = ol.lot_id
+		JOIN order_headers h ON h.id = ol.order_id
+		WHERE l.product_id = $2 AND l.batch_number = ANY($3)
+		GROUP BY h.id, h.user_id, h.email`,
+		recall.ID, recall.ProductID, pq.Array(recall.BatchNumbers))
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to find orders affected by recall %d: %v", recall.ID, err)
+		http.Error(w, "Failed to create recall", http.StatusInternalServerError)
+		return
+	}
+	affected, _ := res.RowsAffected()
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d recalled lots %v of product %d: %d units quarantined, %d orders affected",
+		recall.CreatedBy, recall.BatchNumbers, recall.ProductID, recall.Quarantined, affected)
+
+	go sendRecallNotices(recall.ID)
+
+	recall.Notices = map[string]int{noticePending: int(affected)}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(recall)
+}
+
+// sendRecallNotices sends the notices of a recall that have not been sent
+// yet. It holds a lock on the recall while sending, so a resend does not
+// overlap with one still running; each outcome is recorded outside that
+// transaction so it is kept even if sending is cut short.
+func sendRecallNotices(recallID int) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction for recall %d: %v", recallID, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var productID int
+	var reason, productName string
+	err = tx.QueryRow(`SELECT r.product_id, r.reason, COALESCE(p.name, '') FROM recalls r
+		LEFT JOIN products p ON p.id = r.product_id WHERE r.id = $1
+		FOR UPDATE OF r`, recallID).Scan(&productID, &reason, &productName)
+	if err != nil {
+		log.Printf("Error loading recall %d: %v", recallID, err)
+		return
+	}
+
+	rows, err := tx.Query(`SELECT order_id, user_id, email, quantity, batch_numbers, attempts FROM recall_notices
+		WHERE recall_id = $1 AND status <> $2 ORDER BY order_id`, recallID, noticeSent)
+	if err != nil {
+		log.Printf("Error loading notices of recall %d: %v", recallID, err)
+		return
+	}
+
+	var notices []RecallNotice
+	var attempts []int
+	for rows.Next() {
+		notice := RecallNotice{RecallID: recallID, ProductID: productID, ProductName: productName, Reason: reason}
+		var attempt int
+		err := rows.Scan(&notice.OrderID, &notice.UserID, &notice.EmailID, &notice.Quantity, pq.Array(&notice.BatchNumbers), &attempt)
+		if err != nil {
+			log.Printf("Error scanning notice of recall %d: %v", recallID, err)
+			continue
+		}
+		notices = append(notices, notice)
+		attempts = append(attempts, attempt)
+	}
+	rows.Close()
+
+	for i, notice := range notices {
+		status, lastError := noticeSent, ""
+		if err := sendRecallNotice(notice, attempts[i]); err != nil {
+			log.Printf("Failed to send notice of recall %d for order %s: %v", recallID, notice.OrderID, err)
+			status, lastError = noticeFailed, err.Error()
+		}
+
+		_, err = db.Exec(`UPDATE recall_notices SET status = $1, last_error = $2, attempts = attempts + 1,
+			sent_at = CASE WHEN $1 = 'SENT' THEN NOW() END
+			WHERE recall_id = $3 AND order_id = $4`, status, lastError, recallID, notice.OrderID)
+		if err != nil {
+			log.Printf("Failed to record notice of recall %d for order %s: %v", recallID, notice.OrderID, err)
+		}
+	}
+}
+
+// sendRecallNotice sends one notice. The attempt is part of the idempotency
+// key, so a notice that failed is really sent again rather than answered
+// with the stored failure.
+func sendRecallNotice(notice RecallNotice, attempt int) error {
+	body, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, notificationURL+"/recall", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	token, err := auth.ServiceToken("removedb", notice.UserID)
+	if err != nil {
+		return fmt.Errorf("error issuing service token: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", fmt.Sprintf("recall-%d-%s-%d", notice.RecallID, notice.OrderID, attempt))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("notification service responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// resendRecallNotices sends the recall's failed notices again.
+func resendRecallNotices(w http.ResponseWriter, r *http.Request) {
+	log.Print("resendRecallNotices invoked")
+
+	recallID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid recall ID", http.StatusBadRequest)
+		return
+	}
+
+	if !recallExists(w, recallID) {
+		return
+	}
+
+	go sendRecallNotices(recallID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{
+		"message":   "Sending unsent notices",
+		"recall_id": recallID,
+	})
+}
+
+// recallExists reports whether the recall exists, responding with an error
+// if not.
+func recallExists(w http.ResponseWriter, recallID int) bool {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM recalls WHERE id = $1)", recallID).Scan(&exists)
+	if err != nil {
+		log.Printf("Error loading recall %d: %v", recallID, err)
+		http.Error(w, "Error fetching recall", http.StatusInternalServerError)
+		return false
+	}
+	if !exists {
+		http.Error(w, "Recall not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func listRecalls(w http.ResponseWriter, r *http.Request) {
+	log.Print("listRecalls invoked")
+
+	rows, err := db.Query(`SELECT r.id, r.product_id, r.batch_numbers, r.reason, r.created_by, r.created_at,
+			n.status, COUNT(n.order_id)
+		FROM recalls r LEFT JOIN recall_notices n ON n.recall_id = r.id
+		GROUP BY r.id, n.status
+		ORDER BY r.id DESC`)
+	if err != nil {
+		log.Printf("Error loading recalls: %v", err)
+		http.Error(w, "Error fetching recalls", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	recalls := []*Recall{}
+	byID := make(map[int]*Recall)
+	for rows.Next() {
+		var recall Recall
+		var status sql.NullString
+		var count int
+		err := rows.Scan(&recall.ID, &recall.ProductID, pq.Array(&recall.BatchNumbers), &recall.Reason,
+			&recall.CreatedBy, &recall.CreatedAt, &status, &count)
+		if err != nil {
+			log.Printf("Error scanning recall: %v", err)
+			http.Error(w, "Error fetching recalls", http.StatusInternalServerError)
+			return
+		}
+
+		existing, ok := byID[recall.ID]
+		if !ok {
+			recall.Notices = make(map[string]int)
+			existing = &recall
+			byID[recall.ID] = existing
+			recalls = append(recalls, existing)
+		}
+		if status.Valid {
+			existing.Notices[status.String] = count
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recalls)
+}
+
+// recallReport writes the customers affected by a recall, and whether they
+// have been told, as CSV.
+func recallReport(w http.ResponseWriter, r *http.Request) {
+	log.Print("recallReport invoked")
+
+	recallID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid recall ID", http.StatusBadRequest)
+		return
+	}
+
+	if !recallExists(w, recallID) {
+		return
+	}
+
+	rows, err := db.Query(`SELECT n.order_id, n.user_id, n.email, r.product_id, n.batch_numbers, n.quantity,
+			n.status, n.attempts, n.sent_at, n.last_error
+		FROM recall_notices n JOIN recalls r ON r.id = n.recall_id
+		WHERE n.recall_id = $1 ORDER BY n.order_id`, recallID)
+	if err != nil {
+		log.Printf("Error loading notices of recall %d: %v", recallID, err)
+		http.Error(w, "Error fetching recall report", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="recall-%d.csv"`, recallID))
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"order_id", "user_id", "email", "product_id", "batch_numbers", "quantity",
+		"contact_status", "attempts", "sent_at", "last_error"})
+	for rows.Next() {
+		var orderID, email, status, lastError string
+		var userID, productID, quantity, attempts int
+		var batches []string
+		var sentAt sql.NullTime
+		err := rows.Scan(&orderID, &userID, &email, &productID, pq.Array(&batches), &quantity,
+			&status, &attempts, &sentAt, &lastError)
+		if err != nil {
+			log.Printf("Error scanning notice of recall %d: %v", recallID, err)
+			break
+		}
+
+		var sent string
+		if sentAt.Valid {
+			sent = sentAt.Time.Format(time.RFC3339)
+		}
+		out.Write([]string{csvCell(orderID), strconv.Itoa(userID), csvCell(email), strconv.Itoa(productID),
+			csvCell(strings.Join(batches, " ")), strconv.Itoa(quantity), status, strconv.Itoa(attempts), sent,
+			csvCell(lastError)})
+	}
+	out.Flush()
+}
+
+// csvCell keeps a spreadsheet from reading a value as a formula by quoting
+// values that start like one.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
@@ -0,0 +1,10 @@
+package main
+
+import "database/sql"
+
+// releaseAllocation drops the allocation of an order, once its stock has
+// been removed or when the order gives it back.
+func releaseAllocation(tx *sql.Tx, orderID string) error {
+	_, err := tx.Exec("DELETE FROM stock_reservations WHERE order_id = $1", orderID)
+	return err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"shared/auth"
+)
+
+// stock_adjustments records every manual change of a lot's stock, such as a
+// delivery being booked in or damaged stock being written off.
+const stockSchema = `
+CREATE TABLE IF NOT EXISTS stock_adjustments (
+	id SERIAL PRIMARY KEY,
+	product_id INTEGER NOT NULL,
+	delta INTEGER NOT NULL,
+	reason TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS stock_adjustments_product_id_idx ON stock_adjustments (product_id);`
+
+// A delivery of a new lot must give its expiry date, in YYYY-MM-DD form.
+type StockAdjustment struct {
+	ProductID   int    `json:"product_id"`
+	BatchNumber string `json:"batch_number"`
+	ExpiryDate  string `json:"expiry_date"`
+	Delta       int    `json:"delta"`
+	Reason      string `json:"reason"`
+}
+
+func initStock() error {
+	_, err := db.Exec(stockSchema)
+	if err != nil {
+		return fmt.Errorf("error creating stock adjustments table: %w", err)
+	}
+	return nil
+}
+
+// adjustStock adds delta, which may be negative, to the stock of a lot of a
+// product, booking the lot in if it is new. Stock never drops below zero.
+func adjustStock(w http.ResponseWriter, r *http.Request) {
+	log.Print("adjustStock invoked")
+
+	var adj StockAdjustment
+	err := json.NewDecoder(r.Body).Decode(&adj)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	adj.Reason = strings.TrimSpace(adj.Reason)
+	adj.BatchNumber = strings.TrimSpace(adj.BatchNumber)
+	if adj.Delta == 0 || adj.Reason == "" || adj.BatchNumber == "" {
+		http.Error(w, "delta must be non-zero and a batch number and reason are required", http.StatusBadRequest)
+		return
+	}
+
+	var expiry *time.Time
+	if adj.ExpiryDate != "" {
+		t, err := time.Parse(time.DateOnly, adj.ExpiryDate)
+		if err != nil {
+			http.Error(w, "expiry_date must be in YYYY-MM-DD form", http.StatusBadRequest)
+			return
+		}
+		expiry = &t
+	}
+
+	user := auth.CurrentUser(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+		return
+	}
+
+	var quantity int
+	err = tx.QueryRow("SELECT quantity FROM products WHERE id = $1 FOR UPDATE", adj.ProductID).Scan(&quantity)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, "Failed to adjust stock", http.StatusInternalServerError)
+		return
+	}
+
+	var lotID, lotQuantity int
+	err = tx.QueryRow("SELECT id, quantity FROM product_lots WHERE product_id = $1 AND batch_number = $2 FOR UPDATE",
+		adj.ProductID, adj.BatchNumber).Scan(&lotID, &lotQuantity)
+	if err == sql.ErrNoRows {
+		if adj.Delta < 0 || expiry == nil {
+			tx.Rollback()
+			http.Error(w, fmt.Sprintf("Lot %s of product ID %d does not exist; book it in with its expiry date",
+				adj.BatchNumber, adj.ProductID), http.StatusConflict)
+			return
+		}
+		err = tx.QueryRow("INSERT INTO product_lots (product_id, batch_number, expiry_date, quantity) VALUES ($1, $2, $3, 0) RETURNING id",
+			adj.ProductID, adj.BatchNumber, expiry).Scan(&lotID)
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to load lot %s of product %d: %v", adj.BatchNumber, adj.ProductID, err)
+		http.Error(w, "Failed to adjust stock", http.StatusInternalServerError)
+		return
+	}
+
+	if lotQuantity+adj.Delta < 0 {
+		tx.Rollback()
+		http.Error(w, fmt.Sprintf("Cannot remove %d units from lot %s of product ID %d, only %d in stock",
+			-adj.Delta, adj.BatchNumber, adj.ProductID, lotQuantity), http.StatusConflict)
+		return
+	}
+
+	// Quarantined stock may be written off but is not for sale, so the
+	// product's stock is recounted rather than adjusted by delta.
+	_, err = tx.Exec("UPDATE product_lots SET quantity = quantity + $1 WHERE id = $2", adj.Delta, lotID)
+	if err == nil {
+		err = syncProductQuantity(tx, []int64{int64(adj.ProductID)})
+	}
+	if err == nil {
+		err = tx.QueryRow("SELECT quantity FROM products WHERE id = $1", adj.ProductID).Scan(&quantity)
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to update product stock: %v", err)
+		http.Error(w, "Failed to adjust stock", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO stock_adjustments (product_id, lot_id, delta, reason, user_id) VALUES ($1, $2, $3, $4, $5)",
+		adj.ProductID, lotID, adj.Delta, adj.Reason, user.ID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to record stock adjustment: %v", err)
+		http.Error(w, "Failed to adjust stock", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d adjusted stock of lot %s of product %d by %d: %s",
+		user.ID, adj.BatchNumber, adj.ProductID, adj.Delta, adj.Reason)
+	response := map[string]any{
+		"message":      "Stock adjusted",
+		"product_id":   adj.ProductID,
+		"batch_number": adj.BatchNumber,
+		"lot_quantity": lotQuantity + adj.Delta,
+		"quantity":     quantity,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,215 @@
+// Package auth authenticates requests with the access tokens issued by
+// userservice and the service tokens the services call each other with.
+// Every service shares the JWT_SECRET the tokens are signed with.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	db     *sql.DB
+	jwtKey []byte
+)
+
+// Claims are the claims of the tokens checked here. The subject is the ID
+// of the user the token was issued to or, for service tokens, the user the
+// service is acting for.
+type Claims struct {
+	Email string   `json:"email,omitempty"`
+	Roles []string `json:"roles,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Roles granted by userservice on top of the customer role every user has.
+const (
+	RolePharmacist = "pharmacist"
+	RoleAdmin      = "admin"
+)
+
+// UserIssuer is the issuer of users' access tokens. Tokens from any other
+// issuer are service tokens, issued by the service named as their issuer.
+const UserIssuer = "userservice"
+
+// User is the user a request was authenticated as.
+type User struct {
+	ID    int
+	Email string
+	Roles []string
+
+	// Service is the service that made the request on the user's behalf,
+	// if it came with a service token.
+	Service string
+}
+
+// HasRole reports whether the user holds any of the roles.
+func (u User) HasRole(roles ...string) bool {
+	return slices.ContainsFunc(u.Roles, func(role string) bool { return slices.Contains(roles, role) })
+}
+
+type contextKey int
+
+const userKey contextKey = 0
+
+// WriteError writes the response to a rejected request. Services that
+// answer errors in their own format replace it.
+var WriteError = func(w http.ResponseWriter, message string, statusCode int) {
+	http.Error(w, message, statusCode)
+}
+
+// revoked_tokens is filled by userservice when a user logs out. The table
+// is created by every service so that any of them can start first.
+const schema = `
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	jti TEXT PRIMARY KEY,
+	expires_at TIMESTAMP NOT NULL
+);`
+
+// Init reads JWT_SECRET and checks tokens against the revocations in
+// database.
+func Init(database *sql.DB) error {
+	jwtKey = []byte(os.Getenv("JWT_SECRET"))
+	if len(jwtKey) == 0 {
+		return errors.New("JWT_SECRET is not set")
+	}
+
+	db = database
+	_, err := db.Exec(schema)
+	if err != nil {
+		return fmt.Errorf("error creating revoked tokens table: %w", err)
+	}
+	return nil
+}
+
+// Key returns the secret tokens are signed with.
+func Key() []byte {
+	return jwtKey
+}
+
+// RequireAuth only lets requests carrying a valid token through to next.
+// The token is read from the Authorization header or, failing that, from
+// the token cookie set by userservice.
+func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticate(r)
+		if err != nil {
+			log.Printf("Rejecting unauthenticated request to %s: %v", r.URL.Path, err)
+			WriteError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userKey, user)))
+	}
+}
+
+func authenticate(r *http.Request) (User, error) {
+	tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		cookie, err := r.Cookie("token")
+		if err != nil {
+			return User{}, errors.New("no token")
+		}
+		tokenString = cookie.Value
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(*jwt.Token) (any, error) {
+		return jwtKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return User{}, err
+	}
+
+	if claims.ID == "" {
+		return User{}, errors.New("token has no jti")
+	}
+	if claims.Issuer == "" {
+		return User{}, errors.New("token has no issuer")
+	}
+
+	var revoked bool
+	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)", claims.ID).Scan(&revoked)
+	if err != nil {
+		return User{}, fmt.Errorf("error checking token revocation: %w", err)
+	}
+	if revoked {
+		return User{}, errors.New("token has been revoked")
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return User{}, fmt.Errorf("invalid subject %q", claims.Subject)
+	}
+
+	user := User{ID: id, Email: claims.Email, Roles: claims.Roles}
+	if claims.Issuer != UserIssuer {
+		user.Service = claims.Issuer
+	}
+	return user, nil
+}
+
+// RequireRole is RequireAuth for endpoints restricted to users holding one
+// of the roles.
+func RequireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if !CurrentUser(r).HasRole(roles...) {
+			log.Printf("Rejecting request to %s by user %d without role %v", r.URL.Path, CurrentUser(r).ID, roles)
+			WriteError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// RequireService is RequireAuth for endpoints only the named services may
+// call, such as saga steps and their compensations. Customers cannot call
+// them with their own tokens.
+func RequireService(next http.HandlerFunc, services ...string) http.HandlerFunc {
+	return RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		service := CurrentUser(r).Service
+		if !slices.Contains(services, service) {
+			log.Printf("Rejecting request to %s for user %d from %q", r.URL.Path, CurrentUser(r).ID, service)
+			WriteError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// CurrentUser returns the user RequireAuth authenticated r as.
+func CurrentUser(r *http.Request) User {
+	user, _ := r.Context().Value(userKey).(User)
+	return user
+}
+
+// ServiceToken issues a short-lived token for service to call the other
+// services on behalf of a user. Sagas may run after the user's own token
+// has expired, for example when they are recovered after a restart, so the
+// user's token is not passed on.
+func ServiceToken(service string, userID int) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	claims := &Claims{RegisteredClaims: jwt.RegisteredClaims{
+		ID:        hex.EncodeToString(b),
+		Subject:   strconv.Itoa(userID),
+		Issuer:    service,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+	}}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtKey)
+}
@@ -0,0 +1,35 @@
+// Package carts migrates the cart table, which addtocartservice fills and
+// placeorderservice refills when an order is rolled back. Both upsert cart
+// lines, so both need its unique index whichever of them starts first.
+package carts
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// A cart holds one line per product. Carts from before that rule have their
+// duplicate lines merged once, when the unique index is created; the lock
+// keeps two services starting together from merging them twice.
+const schema = `
+DO $$
+BEGIN
+	PERFORM pg_advisory_xact_lock(hashtext('cart_user_product_idx'));
+	IF NOT EXISTS (SELECT 1 FROM pg_indexes WHERE indexname = 'cart_user_product_idx') THEN
+		CREATE TEMP TABLE cart_merged ON COMMIT DROP AS
+			SELECT user_id, product_id, SUM(quantity) AS quantity FROM cart GROUP BY user_id, product_id;
+		DELETE FROM cart;
+		INSERT INTO cart (user_id, product_id, quantity) SELECT user_id, product_id, quantity FROM cart_merged;
+		CREATE UNIQUE INDEX cart_user_product_idx ON cart (user_id, product_id);
+	END IF;
+END $$;
+ALTER TABLE cart ADD COLUMN IF NOT EXISTS price_cents_at_add BIGINT;`
+
+// Init migrates the cart table in db.
+func Init(db *sql.DB) error {
+	_, err := db.Exec(schema)
+	if err != nil {
+		return fmt.Errorf("error migrating cart table: %w", err)
+	}
+	return nil
+}
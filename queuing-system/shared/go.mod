@@ -0,0 +1,9 @@
+module shared
+
+go 1.22.3
+
+require (
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/lib/pq v1.10.9
+	github.com/streadway/amqp v1.1.0
+)
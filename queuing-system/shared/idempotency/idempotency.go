@@ -0,0 +1,195 @@
+// Package idempotency makes HTTP handlers safe to retry with an
+// Idempotency-Key header. Responses are stored in the idempotency_keys
+// table, which every service shares with its rows scoped by service name.
+// A key only replays responses to the user who sent it, so that one user
+// cannot read another's response by guessing their key.
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"shared/auth"
+)
+
+var (
+	db *sql.DB
+
+	// service scopes this service's rows in idempotency_keys.
+	service string
+)
+
+// Keys stored before they were scoped by subject are kept under the empty
+// subject, which no request has; the lock keeps two services starting
+// together from rebuilding the primary key twice.
+const schema = `
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	service TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	path TEXT NOT NULL,
+	key TEXT NOT NULL,
+	request_hash TEXT NOT NULL,
+	status_code INTEGER,
+	content_type TEXT,
+	body BYTEA,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (service, subject, path, key)
+);
+DO $$
+BEGIN
+	PERFORM pg_advisory_xact_lock(hashtext('idempotency_keys_subject'));
+	IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_name = 'idempotency_keys' AND column_name = 'subject') THEN
+		ALTER TABLE idempotency_keys ADD COLUMN subject TEXT NOT NULL DEFAULT '';
+		ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+		ALTER TABLE idempotency_keys ADD PRIMARY KEY (service, subject, path, key);
+	END IF;
+END $$;`
+
+type storedResponse struct {
+	requestHash string
+	statusCode  int
+	contentType string
+	body        []byte
+}
+
+// responseRecorder passes a response through to the client while keeping a
+// copy of it for the idempotency store.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	rec.statusCode = statusCode
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Init stores responses in database under serviceName.
+func Init(database *sql.DB, serviceName string) error {
+	db, service = database, serviceName
+
+	_, err := db.Exec(schema)
+	if err != nil {
+		return fmt.Errorf("error creating idempotency table: %w", err)
+	}
+	return nil
+}
+
+// Wrap makes next safe to retry. The first request carrying an
+// Idempotency-Key runs next and its response is stored; repeats of that key
+// by the same user get the stored response back instead of running next
+// again. Server errors are not stored, so a retry after one runs next
+// again. Wrap goes inside auth.RequireAuth, which finds the user.
+func Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(sum[:])
+
+		subject := strconv.Itoa(auth.CurrentUser(r).ID)
+		claimed, stored, err := claim(subject, r.URL.Path, key, requestHash)
+		if err != nil {
+			log.Printf("Failed to claim idempotency key %s: %v", key, err)
+			http.Error(w, "Failed to process request", http.StatusInternalServerError)
+			return
+		}
+
+		if !claimed {
+			switch {
+			case stored.requestHash != requestHash:
+				http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+			case stored.statusCode == 0:
+				http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+			default:
+				log.Printf("Replaying response for idempotency key %s", key)
+				w.Header().Set("Content-Type", stored.contentType)
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.statusCode)
+				w.Write(stored.body)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next(rec, r)
+		save(subject, r.URL.Path, key, rec)
+	}
+}
+
+// claim records key as in progress. If the key is already known it returns
+// false together with what is stored for it. Claims left behind by a
+// crashed request expire after five minutes.
+func claim(subject, path, key, requestHash string) (bool, storedResponse, error) {
+	var stored storedResponse
+
+	_, err := db.Exec(`DELETE FROM idempotency_keys
+		WHERE service = $1 AND subject = $2 AND path = $3 AND key = $4
+		AND status_code IS NULL AND created_at < NOW() - INTERVAL '5 minutes'`,
+		service, subject, path, key)
+	if err != nil {
+		return false, stored, err
+	}
+
+	res, err := db.Exec(`INSERT INTO idempotency_keys (service, subject, path, key, request_hash)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`,
+		service, subject, path, key, requestHash)
+	if err != nil {
+		return false, stored, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 1 {
+		return true, stored, nil
+	}
+
+	var statusCode sql.NullInt64
+	var contentType sql.NullString
+	err = db.QueryRow(`SELECT request_hash, status_code, content_type, body FROM idempotency_keys
+		WHERE service = $1 AND subject = $2 AND path = $3 AND key = $4`,
+		service, subject, path, key).Scan(&stored.requestHash, &statusCode, &contentType, &stored.body)
+	if err != nil {
+		return false, stored, err
+	}
+	stored.statusCode = int(statusCode.Int64)
+	stored.contentType = contentType.String
+
+	return false, stored, nil
+}
+
+func save(subject, path, key string, rec *responseRecorder) {
+	var err error
+	if rec.statusCode >= http.StatusInternalServerError {
+		_, err = db.Exec("DELETE FROM idempotency_keys WHERE service = $1 AND subject = $2 AND path = $3 AND key = $4",
+			service, subject, path, key)
+	} else {
+		_, err = db.Exec(`UPDATE idempotency_keys SET status_code = $1, content_type = $2, body = $3
+			WHERE service = $4 AND subject = $5 AND path = $6 AND key = $7`,
+			rec.statusCode, rec.Header().Get("Content-Type"), rec.body.Bytes(), service, subject, path, key)
+	}
+	if err != nil {
+		log.Printf("Failed to store response for idempotency key %s: %v", key, err)
+	}
+}
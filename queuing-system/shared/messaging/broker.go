@@ -0,0 +1,217 @@
+// Package messaging carries saga requests and their results between the
+// orchestrator and the services over a message broker.
+package messaging
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Message is a request or result event carried by a Broker.
+type Message struct {
+	Headers map[string]string
+	Body    []byte
+}
+
+// Broker delivers messages between the orchestrator and the services. A
+// handler that returns an error has its message redelivered.
+type Broker interface {
+	// Declare makes sure queue exists, so that messages published to it
+	// before anyone consumes from it are kept.
+	Declare(queue string) error
+	Publish(queue string, msg Message) error
+	Consume(queue string, handle func(Message) error) error
+	// ConsumeTemporary consumes from a new queue that lives only as long
+	// as this broker connection and returns the queue's name.
+	ConsumeTemporary(handle func(Message) error) (string, error)
+	Close() error
+}
+
+// amqpBroker is a Broker backed by RabbitMQ or any other AMQP 0-9-1 server.
+type amqpBroker struct {
+	conn *amqp.Connection
+	ch   *amqp.Channel
+
+	mu       sync.Mutex
+	declared map[string]bool
+}
+
+// NewAMQPBroker connects to the AMQP server at url.
+func NewAMQPBroker(url string) (Broker, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to AMQP server: %w", err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error opening AMQP channel: %w", err)
+	}
+
+	return &amqpBroker{conn: conn, ch: ch, declared: make(map[string]bool)}, nil
+}
+
+func (b *amqpBroker) Declare(queue string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.declare(queue)
+}
+
+// declare declares queue as durable. The caller holds b.mu.
+func (b *amqpBroker) declare(queue string) error {
+	if b.declared[queue] {
+		return nil
+	}
+	_, err := b.ch.QueueDeclare(queue, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("error declaring queue %s: %w", queue, err)
+	}
+	b.declared[queue] = true
+	return nil
+}
+
+// Publish sends msg to queue. Queues are not declared here: reply queues
+// are temporary queues owned by their consumer, and request queues are
+// declared by the orchestrator at startup.
+func (b *amqpBroker) Publish(queue string, msg Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+
+	return b.ch.Publish("", queue, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Headers:      headers,
+		Body:         msg.Body,
+	})
+}
+
+func (b *amqpBroker) Consume(queue string, handle func(Message) error) error {
+	if err := b.Declare(queue); err != nil {
+		return err
+	}
+	return b.consume(queue, handle)
+}
+
+func (b *amqpBroker) ConsumeTemporary(handle func(Message) error) (string, error) {
+	b.mu.Lock()
+	q, err := b.ch.QueueDeclare("", false, true, true, false, nil)
+	b.mu.Unlock()
+	if err != nil {
+		return "", fmt.Errorf("error declaring temporary queue: %w", err)
+	}
+
+	return q.Name, b.consume(q.Name, handle)
+}
+
+// consume handles every delivery in its own goroutine. If the connection
+// drops the process exits so that it is restarted with a fresh one.
+func (b *amqpBroker) consume(queue string, handle func(Message) error) error {
+	deliveries, err := b.ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("error consuming from queue %s: %w", queue, err)
+	}
+
+	go func() {
+		for d := range deliveries {
+			go func(d amqp.Delivery) {
+				msg := Message{Headers: make(map[string]string), Body: d.Body}
+				for k, v := range d.Headers {
+					if s, ok := v.(string); ok {
+						msg.Headers[k] = s
+					}
+				}
+
+				if err := handle(msg); err != nil {
+					log.Printf("Error handling message from %s, requeueing: %v", queue, err)
+					d.Nack(false, true)
+					return
+				}
+				d.Ack(false)
+			}(d)
+		}
+		log.Fatalf("Consumer for queue %s stopped", queue)
+	}()
+
+	return nil
+}
+
+func (b *amqpBroker) Close() error {
+	b.ch.Close()
+	return b.conn.Close()
+}
+
+// memoryBroker is an in-process Broker. Messages are lost when the process
+// exits.
+type memoryBroker struct {
+	mu     sync.Mutex
+	queues map[string]chan Message
+	temp   int
+}
+
+// NewMemoryBroker returns a Broker that only delivers within this process.
+func NewMemoryBroker() Broker {
+	return &memoryBroker{queues: make(map[string]chan Message)}
+}
+
+func (b *memoryBroker) queue(name string) chan Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		q = make(chan Message, 1024)
+		b.queues[name] = q
+	}
+	return q
+}
+
+func (b *memoryBroker) Declare(queue string) error {
+	b.queue(queue)
+	return nil
+}
+
+func (b *memoryBroker) Publish(queue string, msg Message) error {
+	b.queue(queue) <- msg
+	return nil
+}
+
+func (b *memoryBroker) Consume(queue string, handle func(Message) error) error {
+	q := b.queue(queue)
+
+	go func() {
+		for msg := range q {
+			go func(msg Message) {
+				if err := handle(msg); err != nil {
+					log.Printf("Error handling message from %s, requeueing: %v", queue, err)
+					time.Sleep(time.Second)
+					b.Publish(queue, msg)
+				}
+			}(msg)
+		}
+	}()
+
+	return nil
+}
+
+func (b *memoryBroker) ConsumeTemporary(handle func(Message) error) (string, error) {
+	b.mu.Lock()
+	b.temp++
+	name := fmt.Sprintf("temporary.%d", b.temp)
+	b.mu.Unlock()
+
+	return name, b.Consume(name, handle)
+}
+
+func (b *memoryBroker) Close() error {
+	return nil
+}
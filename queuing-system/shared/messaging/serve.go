@@ -0,0 +1,41 @@
+package messaging
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+)
+
+// Serve answers the requests arriving on queue with handler, normally the
+// service's http.DefaultServeMux so that queued and HTTP requests take the
+// same path, and publishes each response as a result event to the queue
+// named in the request's Reply-To header.
+func Serve(broker Broker, queue string, handler http.Handler) error {
+	return broker.Consume(queue, func(msg Message) error {
+		req, err := http.NewRequest(http.MethodPost, msg.Headers["Path"], bytes.NewReader(msg.Body))
+		if err != nil {
+			log.Printf("Dropping malformed request from %s: %v", queue, err)
+			return nil
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if key := msg.Headers["Idempotency-Key"]; key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		if auth := msg.Headers["Authorization"]; auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return broker.Publish(msg.Headers["Reply-To"], Message{
+			Headers: map[string]string{
+				"Correlation-Id": msg.Headers["Correlation-Id"],
+				"Status":         strconv.Itoa(rec.Code),
+			},
+			Body: rec.Body.Bytes(),
+		})
+	})
+}
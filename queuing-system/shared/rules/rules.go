@@ -0,0 +1,235 @@
+// Package rules checks purchases against the purchase_rules table. The
+// cart checks them when a product is added and the order service again
+// when the order is placed.
+package rules
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// purchase_rules restrict how much of a product, or of every product in a
+// category, a customer may buy:
+//
+//   - max_per_order caps the quantity in one cart or order,
+//   - max_per_period caps the quantity bought over the last period_days,
+//     counted from the orders table,
+//   - min_age requires the customer's date of birth to be on file and them
+//     to be at least that old.
+//
+// Any column may be NULL to leave that limit out. A rule covers the
+// products matching both its product_id and its category, leaving out
+// whichever is unset, so a rule with only a category sums its limits over
+// all products of the category, e.g. every pseudoephedrine product.
+const schema = `
+CREATE TABLE IF NOT EXISTS purchase_rules (
+	id SERIAL PRIMARY KEY,
+	product_id INTEGER,
+	category TEXT,
+	max_per_order INTEGER,
+	max_per_period INTEGER,
+	period_days INTEGER,
+	min_age INTEGER,
+	description TEXT NOT NULL DEFAULT '',
+	active BOOLEAN NOT NULL DEFAULT TRUE,
+	CHECK (product_id IS NOT NULL OR category IS NOT NULL),
+	CHECK (max_per_period IS NULL OR period_days IS NOT NULL)
+);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS date_of_birth DATE;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS category TEXT NOT NULL DEFAULT '';`
+
+type rule struct {
+	id           int
+	productID    sql.NullInt64
+	category     sql.NullString
+	maxPerOrder  sql.NullInt64
+	maxPerPeriod sql.NullInt64
+	periodDays   sql.NullInt64
+	minAge       sql.NullInt64
+	description  string
+}
+
+// Line is a quantity of a product the customer wants to buy.
+type Line struct {
+	ProductID int
+	Quantity  int
+}
+
+// Violation is a reason a purchase is refused.
+type Violation struct {
+	RuleID    int    `json:"rule_id"`
+	ProductID int    `json:"product_id"`
+	Reason    string `json:"reason"`
+}
+
+// Queryer is a database or a transaction.
+type Queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Init creates the purchase_rules table in db, along with the columns the
+// rules are checked against.
+func Init(db *sql.DB) error {
+	_, err := db.Exec(schema)
+	if err != nil {
+		return fmt.Errorf("error creating purchase rules table: %w", err)
+	}
+	return nil
+}
+
+// matches reports whether the rule covers a product of the category.
+// historyFilter is the same test in SQL.
+func (r rule) matches(productID int, category string) bool {
+	if r.productID.Valid && int(r.productID.Int64) != productID {
+		return false
+	}
+	if r.category.String != "" && !strings.EqualFold(r.category.String, category) {
+		return false
+	}
+	return true
+}
+
+// historyFilter selects the products of p the rule covers, given the rule's
+// product_id and category as $4 and $5.
+const historyFilter = `($4::INTEGER IS NULL OR p.id = $4)
+	AND (COALESCE($5::TEXT, '') = '' OR LOWER(p.category) = LOWER($5))`
+
+func (r rule) subject() string {
+	if r.description != "" {
+		return r.description
+	}
+	if r.productID.Valid {
+		return fmt.Sprintf("product ID %d", r.productID.Int64)
+	}
+	return r.category.String + " products"
+}
+
+// Check evaluates every active rule covering the lines the user wants to
+// buy. orderID names the order being placed so that it is not counted in
+// the user's history; it is empty when adding to the cart.
+func Check(q Queryer, userID int, orderID string, lines []Line) ([]Violation, error) {
+	var productIDs []int64
+	for _, line := range lines {
+		productIDs = append(productIDs, int64(line.ProductID))
+	}
+
+	categories := make(map[int]string)
+	rows, err := q.Query("SELECT id, category FROM products WHERE id = ANY($1)", pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		var category string
+		if err := rows.Scan(&id, &category); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		categories[id] = category
+	}
+	rows.Close()
+
+	var categoryNames []string
+	for _, category := range categories {
+		categoryNames = append(categoryNames, strings.ToLower(category))
+	}
+
+	rows, err = q.Query(`SELECT id, product_id, category, max_per_order, max_per_period, period_days, min_age, description
+		FROM purchase_rules
+		WHERE active AND (product_id = ANY($1) OR LOWER(category) = ANY($2))
+		ORDER BY id`, pq.Array(productIDs), pq.Array(categoryNames))
+	if err != nil {
+		return nil, err
+	}
+	var rules []rule
+	for rows.Next() {
+		var r rule
+		err := rows.Scan(&r.id, &r.productID, &r.category, &r.maxPerOrder, &r.maxPerPeriod,
+			&r.periodDays, &r.minAge, &r.description)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	rows.Close()
+
+	violations := []Violation{}
+	for _, r := range rules {
+		quantity, productID := 0, 0
+		for _, line := range lines {
+			if r.matches(line.ProductID, categories[line.ProductID]) {
+				quantity += line.Quantity
+				productID = line.ProductID
+			}
+		}
+		if quantity == 0 {
+			continue
+		}
+
+		violation := func(format string, args ...any) {
+			violations = append(violations, Violation{
+				RuleID:    r.id,
+				ProductID: productID,
+				Reason:    fmt.Sprintf(format, args...),
+			})
+		}
+
+		if r.maxPerOrder.Valid && int64(quantity) > r.maxPerOrder.Int64 {
+			violation("At most %d of %s may be bought per order", r.maxPerOrder.Int64, r.subject())
+		}
+
+		if r.maxPerPeriod.Valid {
+			var bought int64
+			err := q.QueryRow(`SELECT COALESCE(SUM(o.quantity), 0) FROM orders o JOIN products p ON p.id = o.product_id
+				WHERE o.user_id = $1 AND o.order_date >= NOW() - make_interval(days => $2)
+				AND o.order_id IS DISTINCT FROM NULLIF($3, '')
+				AND `+historyFilter,
+				userID, r.periodDays.Int64, orderID, r.productID, r.category).Scan(&bought)
+			if err != nil {
+				return nil, err
+			}
+			if bought+int64(quantity) > r.maxPerPeriod.Int64 {
+				violation("At most %d of %s may be bought every %d days; you have bought %d already",
+					r.maxPerPeriod.Int64, r.subject(), r.periodDays.Int64, bought)
+			}
+		}
+
+		if r.minAge.Valid {
+			var age sql.NullInt64
+			err := q.QueryRow("SELECT DATE_PART('year', AGE(date_of_birth))::INTEGER FROM users WHERE id = $1",
+				userID).Scan(&age)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+			if !age.Valid {
+				violation("%s requires your date of birth on file", r.subject())
+			} else if age.Int64 < r.minAge.Int64 {
+				violation("You must be at least %d to buy %s", r.minAge.Int64, r.subject())
+			}
+		}
+	}
+
+	return violations, nil
+}
+
+// WriteViolations refuses a purchase with the reasons for it.
+func WriteViolations(w http.ResponseWriter, violations []Violation) {
+	reasons := make([]string, len(violations))
+	for i, v := range violations {
+		reasons[i] = v.Reason
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]any{
+		"message":    strings.Join(reasons, "; "),
+		"violations": violations,
+	})
+}
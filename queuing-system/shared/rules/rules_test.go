@@ -0,0 +1,35 @@
+package rules
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestRuleMatches(t *testing.T) {
+	product := func(id int64) sql.NullInt64 { return sql.NullInt64{Int64: id, Valid: true} }
+	category := func(name string) sql.NullString { return sql.NullString{String: name, Valid: true} }
+
+	tests := []struct {
+		name      string
+		rule      rule
+		productID int
+		category  string
+		want      bool
+	}{
+		{"product", rule{productID: product(7)}, 7, "Cold & Flu", true},
+		{"other product", rule{productID: product(7)}, 8, "Cold & Flu", false},
+		{"category", rule{category: category("Cold & Flu")}, 8, "Cold & Flu", true},
+		{"category ignores case", rule{category: category("cold & flu")}, 8, "COLD & FLU", true},
+		{"other category", rule{category: category("Cold & Flu")}, 8, "Vitamins", false},
+		{"empty category is unset", rule{productID: product(7), category: category("")}, 7, "Vitamins", true},
+		{"product and category", rule{productID: product(7), category: category("Cold & Flu")}, 7, "Cold & Flu", true},
+		{"product but not category", rule{productID: product(7), category: category("Cold & Flu")}, 7, "Vitamins", false},
+		{"category but not product", rule{productID: product(7), category: category("Cold & Flu")}, 8, "Cold & Flu", false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rule.matches(tt.productID, tt.category); got != tt.want {
+			t.Errorf("%s: matches(%d, %q) = %t, want %t", tt.name, tt.productID, tt.category, got, tt.want)
+		}
+	}
+}
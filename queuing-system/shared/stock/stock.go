@@ -0,0 +1,91 @@
+// Package stock defines what stock a product has available to promise. The
+// cart, search and removedb's inventory API all check stock against it.
+package stock
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Stock is held in product_lots, each a batch of a product with its own
+// expiry date. Expired and quarantined lots are never sold. removedb books
+// stock into lots and takes it out again; stock booked in before lots were
+// tracked is moved to an UNTRACKED lot without an expiry date.
+//
+// stock_reservations holds stock for customers so that two customers cannot
+// both cart the last unit. A cart reservation has no order and expires
+// after RESERVATION_TTL, set in addtocartservice, unless the cart is
+// ordered; removedb's inventory API then turns it into an allocation of the
+// order, which never expires and is dropped once the stock has been removed
+// or given back. Stock that is neither reserved nor allocated is available
+// to promise.
+const schema = `
+CREATE TABLE IF NOT EXISTS product_lots (
+	id SERIAL PRIMARY KEY,
+	product_id INTEGER NOT NULL,
+	batch_number TEXT NOT NULL,
+	expiry_date DATE,
+	quantity INTEGER NOT NULL CHECK (quantity >= 0),
+	received_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	UNIQUE (product_id, batch_number)
+);
+CREATE INDEX IF NOT EXISTS product_lots_product_expiry_idx ON product_lots (product_id, expiry_date);
+ALTER TABLE product_lots ADD COLUMN IF NOT EXISTS quarantined BOOLEAN NOT NULL DEFAULT FALSE;
+INSERT INTO product_lots (product_id, batch_number, quantity)
+	SELECT p.id, 'UNTRACKED', p.quantity FROM products p
+	WHERE p.quantity > 0 AND NOT EXISTS (SELECT 1 FROM product_lots l WHERE l.product_id = p.id)
+ON CONFLICT DO NOTHING;
+CREATE TABLE IF NOT EXISTS stock_reservations (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	product_id INTEGER NOT NULL,
+	quantity INTEGER NOT NULL CHECK (quantity > 0),
+	order_id TEXT,
+	expires_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS stock_reservations_cart_idx ON stock_reservations (user_id, product_id)
+	WHERE order_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS stock_reservations_order_idx ON stock_reservations (order_id, product_id)
+	WHERE order_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS stock_reservations_product_idx ON stock_reservations (product_id);`
+
+// Init creates the lot and reservation tables in db.
+func Init(db *sql.DB) error {
+	_, err := db.Exec(schema)
+	if err != nil {
+		return fmt.Errorf("error creating stock tables: %w", err)
+	}
+	return nil
+}
+
+// Available returns an SQL expression for the stock of the product whose
+// ID is the expression product that may still be promised to the user
+// whose ID is the expression user: its unexpired lots not in quarantine,
+// less every live reservation and allocation except the user's own cart
+// reservation, which the caller is about to replace. Pass 0 as the user to
+// count every reservation.
+func Available(product, user string) string {
+	return fmt.Sprintf(`(COALESCE((
+			SELECT SUM(l.quantity) FROM product_lots l
+			WHERE l.product_id = %[1]s AND NOT l.quarantined
+				AND (l.expiry_date IS NULL OR l.expiry_date >= CURRENT_DATE)
+		), 0) - COALESCE((
+			SELECT SUM(r.quantity) FROM stock_reservations r
+			WHERE r.product_id = %[1]s
+				AND (r.order_id IS NOT NULL OR r.expires_at > NOW())
+				AND NOT (r.order_id IS NULL AND r.user_id = %[2]s)
+		), 0))`, product, user)
+}
+
+type queryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// AvailableToPromise returns Available for one product. A caller acting on
+// the result must hold the lock on the product row.
+func AvailableToPromise(q queryer, productID, userID int) (int, error) {
+	var available int
+	err := q.QueryRow("SELECT "+Available("$1::INTEGER", "$2::INTEGER"), productID, userID).Scan(&available)
+	return available, err
+}
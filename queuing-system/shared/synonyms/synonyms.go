@@ -0,0 +1,42 @@
+// Package synonyms creates the drug_synonyms table, which maps brand and
+// other names of a drug to its canonical generic name. The product search
+// expands queries with it and the orchestrator matches products against
+// the interaction dataset through it.
+package synonyms
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS drug_synonyms (
+	term TEXT PRIMARY KEY,
+	canonical TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS drug_synonyms_canonical_idx ON drug_synonyms (canonical);
+INSERT INTO drug_synonyms (term, canonical) VALUES
+	('paracetamol', 'acetaminophen'),
+	('tylenol', 'acetaminophen'),
+	('panadol', 'acetaminophen'),
+	('advil', 'ibuprofen'),
+	('motrin', 'ibuprofen'),
+	('nurofen', 'ibuprofen'),
+	('aspirin', 'acetylsalicylic acid'),
+	('bayer', 'acetylsalicylic acid'),
+	('amoxil', 'amoxicillin'),
+	('aleve', 'naproxen'),
+	('claritin', 'loratadine'),
+	('zyrtec', 'cetirizine'),
+	('benadryl', 'diphenhydramine')
+ON CONFLICT DO NOTHING;`
+
+// Init creates the drug_synonyms table in db and adds the built-in
+// synonyms.
+func Init(db *sql.DB) error {
+	_, err := db.Exec(schema)
+	if err != nil {
+		return fmt.Errorf("error creating drug synonyms table: %w", err)
+	}
+	return nil
+}
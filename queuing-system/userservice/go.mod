@@ -4,8 +4,14 @@ go 1.22.3
 
 require (
 	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/gorilla/handlers v1.5.2
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
 	github.com/streadway/amqp v1.1.0
 	golang.org/x/crypto v0.25.0
+	shared v0.0.0-00010101000000-000000000000
 )
+
+require github.com/felixge/httpsnoop v1.0.3 // indirect
+
+replace shared => ../shared
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "log"
+    "net/http"
+    "time"
+)
+
+// cartServiceURL is the addtocartservice, which keeps the carts of guests
+// under the guest_session cookie.
+var cartServiceURL = "http://localhost:9001"
+
+// mergeGuestCart has the guest cart of the browser, if it has one, merged
+// into the cart of the user who just logged in or registered, and ends the
+// guest session. Logging in does not fail if the merge does; the guest
+// cart is then kept, to be merged at the next login.
+func mergeGuestCart(w http.ResponseWriter, r *http.Request, userID int, accessToken string) {
+    cookie, err := r.Cookie("guest_session")
+    if err != nil {
+        return
+    }
+
+    body, err := json.Marshal(map[string]string{"guest_session": cookie.Value})
+    if err != nil {
+        log.Printf("Failed to encode guest cart merge: %v", err)
+        return
+    }
+
+    req, err := http.NewRequest(http.MethodPost, cartServiceURL+"/cart/merge", bytes.NewReader(body))
+    if err != nil {
+        log.Printf("Failed to build guest cart merge: %v", err)
+        return
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Authorization", "Bearer "+accessToken)
+
+    client := &http.Client{Timeout: 10 * time.Second}
+    resp, err := client.Do(req)
+    if err != nil {
+        log.Printf("Failed to merge guest cart into cart of user %d: %v", userID, err)
+        return
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        message, _ := io.ReadAll(resp.Body)
+        log.Printf("Failed to merge guest cart into cart of user %d: %s", userID, bytes.TrimSpace(message))
+        // A session that cannot be verified will never merge.
+        if resp.StatusCode != http.StatusBadRequest {
+            return
+        }
+    } else {
+        var result struct {
+            Merged  []json.RawMessage `json:"merged"`
+            Skipped []json.RawMessage `json:"skipped"`
+        }
+        json.NewDecoder(resp.Body).Decode(&result)
+        log.Printf("Merged guest cart into cart of user %d: %d lines merged, %d skipped",
+            userID, len(result.Merged), len(result.Skipped))
+    }
+
+    cookie = sessionCookie("guest_session", "", 0, true)
+    cookie.MaxAge = -1
+    http.SetCookie(w, cookie)
+}
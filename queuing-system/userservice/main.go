@@ -6,17 +6,21 @@ import (
     "log"
     "net/http"
     "os"
+    "regexp"
+    "strconv"
+    "strings"
     "time"
 
     "github.com/golang-jwt/jwt/v5"
+    "github.com/gorilla/handlers"
     "github.com/joho/godotenv"
     "golang.org/x/crypto/bcrypt"
     _ "github.com/lib/pq"
+
+    "shared/auth"
 )
 
 var db *sql.DB
-var jwtKey = []byte(os.Getenv("JWT_SECRET"))
-
 
 func main() {
     var err error
@@ -31,13 +35,57 @@ func main() {
         log.Fatalf("Error initializing database: %v", err2)
     }
 
-	http.Handle("/", http.FileServer(http.Dir("./static")))
+    err = auth.Init(db)
+    if err != nil {
+        log.Fatalf("Error initializing auth: %v", err)
+    }
+
+    _, err = db.Exec("ALTER TABLE users ADD COLUMN IF NOT EXISTS date_of_birth DATE")
+    if err != nil {
+        log.Fatalf("Error adding date of birth to users: %v", err)
+    }
+
+    _, err = db.Exec("ALTER TABLE users ADD COLUMN IF NOT EXISTS locale TEXT")
+    if err != nil {
+        log.Fatalf("Error adding locale to users: %v", err)
+    }
+
+    err = initTokens()
+    if err != nil {
+        log.Fatalf("Error initializing tokens: %v", err)
+    }
+
+    err = initRoles()
+    if err != nil {
+        log.Fatalf("Error initializing roles: %v", err)
+    }
+
+    if url := os.Getenv("CART_SERVICE_URL"); url != "" {
+        cartServiceURL = strings.TrimRight(url, "/")
+    }
+
+    http.Handle("/", http.FileServer(http.Dir("./static")))
 
     http.HandleFunc("/register", RegisterHandler)
     http.HandleFunc("/login", LoginHandler)
+    http.HandleFunc("/refresh", RefreshHandler)
+    http.HandleFunc("/logout", LogoutHandler)
+
+    http.HandleFunc("GET /admin/users/{id}/roles", auth.RequireRole(GetRolesHandler, auth.RoleAdmin))
+    http.HandleFunc("POST /admin/users/{id}/roles", auth.RequireRole(GrantRoleHandler, auth.RoleAdmin))
+    http.HandleFunc("DELETE /admin/users/{id}/roles/{role}", auth.RequireRole(RevokeRoleHandler, auth.RoleAdmin))
+    http.HandleFunc("GET /admin/roles/audit", auth.RequireRole(RoleAuditHandler, auth.RoleAdmin))
+
+    // The shop pages refresh the session and log out from their own
+    // origins.
+    corsHandler := handlers.CORS(
+        handlers.AllowedOrigins([]string{"http://localhost:9001", "http://localhost:9003"}),
+        handlers.AllowedMethods([]string{"POST", "OPTIONS"}),
+        handlers.AllowCredentials(),
+    )(http.DefaultServeMux)
 
     fmt.Printf("Starting server at port 9000\n")
-    log.Fatal(http.ListenAndServe(":9000", nil))
+    log.Fatal(http.ListenAndServe(":9000", corsHandler))
 }
 
 func InitDB() error {
@@ -63,14 +111,34 @@ func InitDB() error {
     return nil
 }
 
-func generateJWT(userID int) (string, error) {
-    claims := &jwt.RegisteredClaims{
-        ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-        Issuer:    fmt.Sprintf("%d", userID),
+// generateJWT issues an access token. Its jti lets it be revoked on
+// logout.
+func generateJWT(userID int, email string) (string, error) {
+    jti, err := randomToken()
+    if err != nil {
+        return "", err
+    }
+
+    roles, err := loadRoles(userID)
+    if err != nil {
+        return "", err
+    }
+
+    now := time.Now()
+    claims := &auth.Claims{
+        Email: email,
+        Roles: roles,
+        RegisteredClaims: jwt.RegisteredClaims{
+            Subject:   strconv.Itoa(userID),
+            Issuer:    auth.UserIssuer,
+            ID:        jti,
+            IssuedAt:  jwt.NewNumericDate(now),
+            ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+        },
     }
 
     token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    tokenString, err := token.SignedString(jwtKey)
+    tokenString, err := token.SignedString(auth.Key())
     if err != nil {
         return "", err
     }
@@ -90,6 +158,30 @@ func checkPasswordHash(password, hash string) bool {
     return err == nil
 }
 
+// localeTag matches language tags such as en or es-MX.
+var localeTag = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// acceptLanguage returns the language the request's Accept-Language header
+// prefers most, if it names one.
+func acceptLanguage(r *http.Request) string {
+    best, bestQ := "", 0.0
+    for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+        tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+        q := 1.0
+        if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+            parsed, err := strconv.ParseFloat(v, 64)
+            if err != nil {
+                continue
+            }
+            q = parsed
+        }
+        if localeTag.MatchString(tag) && q > bestQ {
+            best, bestQ = strings.ToLower(tag), q
+        }
+    }
+    return best
+}
+
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodPost {
         http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
@@ -105,6 +197,32 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
     email := r.FormValue("email")
     password := r.FormValue("password")
 
+    // The date of birth is optional, but age-restricted products cannot be
+    // bought without it.
+    var dateOfBirth *time.Time
+    if dob := r.FormValue("date_of_birth"); dob != "" {
+        t, err := time.Parse(time.DateOnly, dob)
+        if err != nil || t.After(time.Now()) {
+            http.Error(w, "Invalid date of birth", http.StatusBadRequest)
+            return
+        }
+        dateOfBirth = &t
+    }
+
+    // The locale notifications are written in. Without one the browser's
+    // preferred language is used.
+    var locale *string
+    if l := r.FormValue("locale"); l != "" {
+        if !localeTag.MatchString(l) {
+            http.Error(w, "Invalid locale", http.StatusBadRequest)
+            return
+        }
+        l = strings.ToLower(l)
+        locale = &l
+    } else if l := acceptLanguage(r); l != "" {
+        locale = &l
+    }
+
     var exists bool
     err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email=$1)", email).Scan(&exists)
     if err != nil {
@@ -123,33 +241,21 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
     }
 
     var id int
-    err = db.QueryRow("INSERT INTO users (email, password) VALUES ($1, $2) RETURNING id", email, hashedPassword).Scan(&id)
+    err = db.QueryRow("INSERT INTO users (email, password, date_of_birth, locale) VALUES ($1, $2, $3, $4) RETURNING id",
+        email, hashedPassword, dateOfBirth, locale).Scan(&id)
     if err != nil {
         http.Error(w, "Server error", http.StatusInternalServerError)
         return
     }
 
-    token, err := generateJWT(id)
+    accessToken, err := startSession(w, id, email)
     if err != nil {
+        log.Printf("Failed to start session for user %d: %v", id, err)
         http.Error(w, "Server error", http.StatusInternalServerError)
         return
     }
 
-    http.SetCookie(w, &http.Cookie{
-        Name:  "userID",
-        Value: fmt.Sprintf("%d", id),
-        Path:  "/",
-    })
-    http.SetCookie(w, &http.Cookie{
-        Name:  "userEmail",
-        Value: email,
-        Path:  "/",
-    })
-    http.SetCookie(w, &http.Cookie{
-        Name:  "token",
-        Value: token,
-        Path:  "/",
-    })
+    mergeGuestCart(w, r, id, accessToken)
 
     w.Header().Set("Content-Type", "application/json")
     fmt.Fprintf(w, `{"userID": %d}`, id)
@@ -187,27 +293,14 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    token, err := generateJWT(userID)
+    accessToken, err := startSession(w, userID, email)
     if err != nil {
+        log.Printf("Failed to start session for user %d: %v", userID, err)
         http.Error(w, "Server error", http.StatusInternalServerError)
         return
     }
 
-    http.SetCookie(w, &http.Cookie{
-        Name:  "userID",
-        Value: fmt.Sprintf("%d", userID),
-        Path:  "/",
-    })
-    http.SetCookie(w, &http.Cookie{
-        Name:  "userEmail",
-        Value: email,
-        Path:  "/",
-    })
-    http.SetCookie(w, &http.Cookie{
-        Name:  "token",
-        Value: token,
-        Path:  "/",
-    })
+    mergeGuestCart(w, r, userID, accessToken)
 
     w.Header().Set("Content-Type", "application/json")
     fmt.Fprintf(w, `{"userID": %d}`, userID)
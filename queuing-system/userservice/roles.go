@@ -0,0 +1,286 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "slices"
+    "strconv"
+    "time"
+
+    "shared/auth"
+)
+
+// Every user is a customer. The other roles, auth.RolePharmacist and
+// auth.RoleAdmin, are granted by an admin and carried in the roles claim of
+// access tokens, so a change takes effect when the user's access token is
+// next refreshed.
+const roleCustomer = "customer"
+
+var grantableRoles = []string{auth.RolePharmacist, auth.RoleAdmin}
+
+const roleSchema = `
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    role TEXT NOT NULL,
+    granted_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, role)
+);
+CREATE TABLE IF NOT EXISTS role_audit (
+    id SERIAL PRIMARY KEY,
+    actor_id INTEGER,
+    user_id INTEGER NOT NULL,
+    role TEXT NOT NULL,
+    action TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS role_audit_user_id_idx ON role_audit (user_id);`
+
+type RoleChange struct {
+    ID        int       `json:"id"`
+    ActorID   *int      `json:"actor_id"`
+    UserID    int       `json:"user_id"`
+    Role      string    `json:"role"`
+    Action    string    `json:"action"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+func initRoles() error {
+    _, err := db.Exec(roleSchema)
+    if err != nil {
+        return fmt.Errorf("error creating role tables: %w", err)
+    }
+    return bootstrapAdmin()
+}
+
+// bootstrapAdmin makes the user registered with ADMIN_EMAIL an admin at
+// startup, so that there is someone to grant roles to everyone else. It
+// does nothing until that user has registered, and nothing once their roles
+// have ever been changed, so that revoking the role sticks.
+func bootstrapAdmin() error {
+    email := os.Getenv("ADMIN_EMAIL")
+    if email == "" {
+        return nil
+    }
+
+    var userID int
+    err := db.QueryRow("SELECT id FROM users WHERE email = $1", email).Scan(&userID)
+    if err == sql.ErrNoRows {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    var audited bool
+    err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM role_audit WHERE user_id = $1)", userID).Scan(&audited)
+    if err != nil {
+        return err
+    }
+    if audited {
+        return nil
+    }
+
+    return changeRole(nil, userID, auth.RoleAdmin, "GRANT")
+}
+
+// loadRoles returns every role of the user, customer included.
+func loadRoles(userID int) ([]string, error) {
+    rows, err := db.Query("SELECT role FROM user_roles WHERE user_id = $1 ORDER BY role", userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    roles := []string{roleCustomer}
+    for rows.Next() {
+        var role string
+        if err := rows.Scan(&role); err != nil {
+            return nil, err
+        }
+        roles = append(roles, role)
+    }
+    return roles, rows.Err()
+}
+
+// changeRole grants or revokes a role and records who did it. actorID is
+// nil for changes made by the service itself.
+func changeRole(actorID *int, userID int, role, action string) error {
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var res sql.Result
+    if action == "GRANT" {
+        res, err = tx.Exec("INSERT INTO user_roles (user_id, role) VALUES ($1, $2) ON CONFLICT DO NOTHING", userID, role)
+    } else {
+        res, err = tx.Exec("DELETE FROM user_roles WHERE user_id = $1 AND role = $2", userID, role)
+    }
+    if err != nil {
+        return err
+    }
+
+    // Repeating a grant or revoke changes nothing and is not audited.
+    if n, err := res.RowsAffected(); err == nil && n == 0 {
+        return nil
+    }
+
+    _, err = tx.Exec("INSERT INTO role_audit (actor_id, user_id, role, action) VALUES ($1, $2, $3, $4)",
+        actorID, userID, role, action)
+    if err != nil {
+        return err
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return err
+    }
+
+    log.Printf("%s of role %s for user %d", action, role, userID)
+    return nil
+}
+
+func pathUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+    userID, err := strconv.Atoi(r.PathValue("id"))
+    if err != nil {
+        http.Error(w, "Invalid user ID", http.StatusBadRequest)
+        return 0, false
+    }
+
+    var exists bool
+    err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return 0, false
+    }
+    if !exists {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return 0, false
+    }
+
+    return userID, true
+}
+
+func writeRoles(w http.ResponseWriter, userID int) {
+    roles, err := loadRoles(userID)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{"user_id": userID, "roles": roles})
+}
+
+func GetRolesHandler(w http.ResponseWriter, r *http.Request) {
+    userID, ok := pathUserID(w, r)
+    if !ok {
+        return
+    }
+    writeRoles(w, userID)
+}
+
+func GrantRoleHandler(w http.ResponseWriter, r *http.Request) {
+    userID, ok := pathUserID(w, r)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        Role string `json:"role"`
+    }
+    err := json.NewDecoder(r.Body).Decode(&req)
+    if err != nil {
+        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+        return
+    }
+    if !slices.Contains(grantableRoles, req.Role) {
+        http.Error(w, fmt.Sprintf("Unknown role %q", req.Role), http.StatusBadRequest)
+        return
+    }
+
+    actorID := auth.CurrentUser(r).ID
+    err = changeRole(&actorID, userID, req.Role, "GRANT")
+    if err != nil {
+        log.Printf("Failed to grant role %s to user %d: %v", req.Role, userID, err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    writeRoles(w, userID)
+}
+
+func RevokeRoleHandler(w http.ResponseWriter, r *http.Request) {
+    userID, ok := pathUserID(w, r)
+    if !ok {
+        return
+    }
+
+    role := r.PathValue("role")
+    if !slices.Contains(grantableRoles, role) {
+        http.Error(w, fmt.Sprintf("Unknown role %q", role), http.StatusBadRequest)
+        return
+    }
+
+    actorID := auth.CurrentUser(r).ID
+    if actorID == userID && role == auth.RoleAdmin {
+        http.Error(w, "Admins cannot revoke their own admin role", http.StatusConflict)
+        return
+    }
+
+    err := changeRole(&actorID, userID, role, "REVOKE")
+    if err != nil {
+        log.Printf("Failed to revoke role %s from user %d: %v", role, userID, err)
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    writeRoles(w, userID)
+}
+
+// RoleAuditHandler lists role changes, newest first, optionally only those
+// of one user.
+func RoleAuditHandler(w http.ResponseWriter, r *http.Request) {
+    query := "SELECT id, actor_id, user_id, role, action, created_at FROM role_audit"
+    var args []any
+    if userID := r.URL.Query().Get("userID"); userID != "" {
+        id, err := strconv.Atoi(userID)
+        if err != nil {
+            http.Error(w, "Invalid userID parameter", http.StatusBadRequest)
+            return
+        }
+        query += " WHERE user_id = $1"
+        args = append(args, id)
+    }
+    query += " ORDER BY created_at DESC, id DESC"
+
+    rows, err := db.Query(query, args...)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    defer rows.Close()
+
+    changes := []RoleChange{}
+    for rows.Next() {
+        var c RoleChange
+        var actorID sql.NullInt64
+        if err := rows.Scan(&c.ID, &actorID, &c.UserID, &c.Role, &c.Action, &c.CreatedAt); err != nil {
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+        if actorID.Valid {
+            id := int(actorID.Int64)
+            c.ActorID = &id
+        }
+        changes = append(changes, c)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(changes)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+
+    "shared/auth"
+)
+
+// A session is a short-lived access token, which the other services
+// accept, and a long-lived refresh token, which only this service accepts
+// and which is exchanged for a new pair at /refresh. Refresh tokens are
+// stored hashed and are single use. All refresh tokens descending from the
+// same login share a family; presenting one that was already used revokes
+// the whole family, since either the client or a thief holds a stale copy.
+//
+// Access tokens cannot be withdrawn once issued, so logging out records
+// their jti in revoked_tokens, which shared/auth creates and every service
+// checks.
+const tokenSchema = `
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    family_id TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx ON refresh_tokens (family_id);`
+
+var (
+    accessTokenTTL  = 15 * time.Minute
+    refreshTokenTTL = 30 * 24 * time.Hour
+
+    cookieSecure   = true
+    cookieSameSite = http.SameSiteLaxMode
+    cookieDomain   string
+)
+
+// initTokens creates the refresh token table and reads the token lifetimes and
+// cookie attributes from the environment.
+func initTokens() error {
+    var err error
+
+    if ttl := os.Getenv("ACCESS_TOKEN_TTL"); ttl != "" {
+        accessTokenTTL, err = time.ParseDuration(ttl)
+        if err != nil {
+            return fmt.Errorf("invalid ACCESS_TOKEN_TTL: %w", err)
+        }
+        if accessTokenTTL <= 0 {
+            return fmt.Errorf("invalid ACCESS_TOKEN_TTL %q, it must be positive", ttl)
+        }
+    }
+
+    if ttl := os.Getenv("REFRESH_TOKEN_TTL"); ttl != "" {
+        refreshTokenTTL, err = time.ParseDuration(ttl)
+        if err != nil {
+            return fmt.Errorf("invalid REFRESH_TOKEN_TTL: %w", err)
+        }
+        if refreshTokenTTL <= 0 {
+            return fmt.Errorf("invalid REFRESH_TOKEN_TTL %q, it must be positive", ttl)
+        }
+    }
+
+    if secure := os.Getenv("COOKIE_SECURE"); secure != "" {
+        cookieSecure, err = strconv.ParseBool(secure)
+        if err != nil {
+            return fmt.Errorf("invalid COOKIE_SECURE: %w", err)
+        }
+    }
+
+    switch sameSite := strings.ToLower(os.Getenv("COOKIE_SAMESITE")); sameSite {
+    case "", "lax":
+        cookieSameSite = http.SameSiteLaxMode
+    case "strict":
+        cookieSameSite = http.SameSiteStrictMode
+    case "none":
+        cookieSameSite = http.SameSiteNoneMode
+    default:
+        return fmt.Errorf("invalid COOKIE_SAMESITE %q", sameSite)
+    }
+
+    cookieDomain = os.Getenv("COOKIE_DOMAIN")
+
+    _, err = db.Exec(tokenSchema)
+    if err != nil {
+        return fmt.Errorf("error creating refresh token table: %w", err)
+    }
+    return nil
+}
+
+func randomToken() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// issueRefreshToken stores a new refresh token of the family and returns
+// it.
+func issueRefreshToken(tx *sql.Tx, userID int, familyID string) (string, error) {
+    token, err := randomToken()
+    if err != nil {
+        return "", err
+    }
+
+    _, err = tx.Exec("INSERT INTO refresh_tokens (token_hash, user_id, family_id, expires_at) VALUES ($1, $2, $3, $4)",
+        hashToken(token), userID, familyID, time.Now().Add(refreshTokenTTL))
+    if err != nil {
+        return "", err
+    }
+    return token, nil
+}
+
+// startSession logs the user in with a new refresh token family and
+// returns the access token.
+func startSession(w http.ResponseWriter, userID int, email string) (string, error) {
+    familyID, err := randomToken()
+    if err != nil {
+        return "", err
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return "", err
+    }
+
+    refreshToken, err := issueRefreshToken(tx, userID, familyID)
+    if err != nil {
+        tx.Rollback()
+        return "", err
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return "", err
+    }
+
+    accessToken, err := generateJWT(userID, email)
+    if err != nil {
+        return "", err
+    }
+
+    setSessionCookies(w, userID, email, accessToken, refreshToken)
+    return accessToken, nil
+}
+
+func sessionCookie(name, value string, maxAge time.Duration, httpOnly bool) *http.Cookie {
+    return &http.Cookie{
+        Name:     name,
+        Value:    value,
+        Path:     "/",
+        Domain:   cookieDomain,
+        MaxAge:   int(maxAge.Seconds()),
+        Secure:   cookieSecure,
+        HttpOnly: httpOnly,
+        SameSite: cookieSameSite,
+    }
+}
+
+// setSessionCookies sets the tokens, which scripts cannot read, and the
+// user's ID and email, which the pages use to show who is logged in.
+func setSessionCookies(w http.ResponseWriter, userID int, email, accessToken, refreshToken string) {
+    http.SetCookie(w, sessionCookie("token", accessToken, accessTokenTTL, true))
+    http.SetCookie(w, sessionCookie("refresh_token", refreshToken, refreshTokenTTL, true))
+    http.SetCookie(w, sessionCookie("userID", strconv.Itoa(userID), refreshTokenTTL, false))
+    http.SetCookie(w, sessionCookie("userEmail", email, refreshTokenTTL, false))
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+    for _, name := range []string{"token", "refresh_token", "userID", "userEmail"} {
+        cookie := sessionCookie(name, "", 0, true)
+        cookie.MaxAge = -1
+        http.SetCookie(w, cookie)
+    }
+}
+
+func revokeFamily(familyID string) error {
+    _, err := db.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL", familyID)
+    return err
+}
+
+// RefreshHandler exchanges the refresh token for a new access token and a
+// new refresh token.
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+
+    cookie, err := r.Cookie("refresh_token")
+    if err != nil {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+    defer tx.Rollback()
+
+    var userID int
+    var familyID string
+    var expiresAt time.Time
+    var revokedAt sql.NullTime
+    err = tx.QueryRow(`SELECT user_id, family_id, expires_at, revoked_at FROM refresh_tokens
+        WHERE token_hash = $1 FOR UPDATE`, hashToken(cookie.Value)).Scan(&userID, &familyID, &expiresAt, &revokedAt)
+    if err == sql.ErrNoRows {
+        clearSessionCookies(w)
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    if revokedAt.Valid {
+        log.Printf("Refresh token of user %d reused, revoking its family", userID)
+        tx.Rollback()
+        if err := revokeFamily(familyID); err != nil {
+            log.Printf("Failed to revoke refresh token family: %v", err)
+        }
+        clearSessionCookies(w)
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    if time.Now().After(expiresAt) {
+        clearSessionCookies(w)
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var email string
+    err = tx.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    _, err = tx.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE token_hash = $1", hashToken(cookie.Value))
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    refreshToken, err := issueRefreshToken(tx, userID, familyID)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    accessToken, err := generateJWT(userID, email)
+    if err != nil {
+        http.Error(w, "Server error", http.StatusInternalServerError)
+        return
+    }
+
+    setSessionCookies(w, userID, email, accessToken, refreshToken)
+
+    w.Header().Set("Content-Type", "application/json")
+    fmt.Fprintf(w, `{"userID": %d}`, userID)
+}
+
+// LogoutHandler ends the session: the refresh token family is revoked and
+// the access token is put on the revocation list until it expires.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if cookie, err := r.Cookie("refresh_token"); err == nil {
+        var familyID string
+        err = db.QueryRow("SELECT family_id FROM refresh_tokens WHERE token_hash = $1", hashToken(cookie.Value)).Scan(&familyID)
+        if err == nil {
+            err = revokeFamily(familyID)
+        }
+        if err != nil && err != sql.ErrNoRows {
+            log.Printf("Failed to revoke refresh token: %v", err)
+            http.Error(w, "Server error", http.StatusInternalServerError)
+            return
+        }
+    }
+
+    if cookie, err := r.Cookie("token"); err == nil {
+        claims := &auth.Claims{}
+        _, err := jwt.ParseWithClaims(cookie.Value, claims, func(*jwt.Token) (any, error) {
+            return auth.Key(), nil
+        }, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+        if err == nil && claims.ID != "" && claims.ExpiresAt != nil {
+            _, err = db.Exec("INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+                claims.ID, claims.ExpiresAt.Time)
+            if err != nil {
+                log.Printf("Failed to revoke access token: %v", err)
+                http.Error(w, "Server error", http.StatusInternalServerError)
+                return
+            }
+        }
+    }
+
+    _, err := db.Exec("DELETE FROM revoked_tokens WHERE expires_at < NOW()")
+    if err != nil {
+        log.Printf("Failed to prune revoked tokens: %v", err)
+    }
+
+    clearSessionCookies(w)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+}